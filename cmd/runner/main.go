@@ -2,33 +2,542 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/caelifer/runner/component"
 	"github.com/caelifer/runner/component/job"
 	"github.com/caelifer/runner/component/task"
-	"github.com/caelifer/runner/service/store/memory"
+	"github.com/caelifer/runner/service/cluster"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/metrics"
+	"github.com/caelifer/runner/service/queue"
+	"github.com/caelifer/runner/service/retention"
+	"github.com/caelifer/runner/service/scheduler"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/cache"
+	"github.com/caelifer/runner/service/tracing"
+	"github.com/caelifer/runner/service/workspace"
+
+	// installing data store backends
+	_ "github.com/caelifer/runner/service/store/file"
+	_ "github.com/caelifer/runner/service/store/memory"
+	_ "github.com/caelifer/runner/service/store/mysql"
+	_ "github.com/caelifer/runner/service/store/postgres"
+	_ "github.com/caelifer/runner/service/store/sqlite"
+)
+
+var (
+	mode        = flag.String("mode", "local", "execution mode: local, coordinator, worker, queue (show coordinator's queue), list (list stored records) or gc (remove job history out of retention)")
+	addr        = flag.String("addr", "127.0.0.1:7070", "coordinator address to listen on or to connect to")
+	schedule    = flag.String("schedule", "", "cron expression to run the job periodically, e.g. \"*/30 * * * * *\"")
+	worker      = flag.String("worker", "", "stable worker id; in local mode runs queue worker")
+	submit      = flag.Bool("submit", false, "submit the job to the queue instead of running it")
+	labels      = flag.String("labels", "", "comma separated worker labels, e.g. \"gpu=true,size=large\"")
+	cpu         = flag.Int("cpu", runtime.NumCPU(), "number of CPUs offered by worker")
+	mem         = flag.Int64("memory", 1024, "memory in MiB offered by worker")
+	slots       = flag.Int("slots", 0, "number of tasks worker runs concurrently, defaults to number of CPUs")
+	tenant      = flag.String("tenant", "", "tenant owning the job")
+	priority    = flag.Int("priority", 0, "job priority within its tenant, higher runs first")
+	weights     = flag.String("weights", "", "comma separated tenant weights for coordinator and queue workers, e.g. \"media=3,backfill=1\"")
+	logLevel    = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	metricsAddr = flag.String("metrics-addr", "", "address to expose Prometheus metrics at /metrics, e.g. \":9090\"")
+	traceFile   = flag.String("trace-file", "", "file to write trace spans to as JSON lines")
+	otlpAddr    = flag.String("otlp-endpoint", "", "OTLP/HTTP collector to export trace spans to, e.g. \"http://localhost:4318\"")
+	kind        = flag.String("kind", "job", "list: kind of records, e.g. job or task; empty lists all")
+	status      = flag.String("status", "", "list: comma separated statuses, e.g. \"failed,timed_out\"")
+	since       = flag.Duration("since", 0, "list: only records created within this duration, e.g. 24h")
+	name        = flag.String("name", "", "list: only records with this name")
+	jobID       = flag.String("job", "", "list: only tasks of this job")
+	limit       = flag.Int("limit", store.DefaultLimit, "list: maximal number of records")
+	cursor      = flag.String("cursor", "", "list: continue listing after this record id")
+	keepLast    = flag.Int("keep-last", 0, "retention: number of the latest runs of every job kept; 0 keeps all")
+	keepOK      = flag.Duration("keep-succeeded", 0, "retention: how long succeeded jobs are kept, e.g. 168h; 0 keeps them forever")
+	keepFailed  = flag.Duration("keep-failed", 0, "retention: how long jobs which did not succeed are kept; 0 keeps them forever")
+	gcInterval  = flag.Duration("gc-interval", retention.DefaultInterval, "retention: how often job history is collected")
+	dryRun      = flag.Bool("dry-run", false, "gc: only report what would be removed")
+	storeURL    = flag.String("store", "memory://", "data store URL, e.g. file:///var/lib/runner, sqlite:///var/lib/runner.db, mysql://user@host/db or postgres://user@host/db")
+	cacheSize   = flag.Int("cache-size", 0, "number of records cached in front of data store; 0 disables cache")
+	cacheTTL    = flag.Duration("cache-ttl", cache.DefaultTTL, "how long records stay cached")
+	storeFail   = flag.String("store-failure", "fail", "what jobs do when their state can't be stored: fail, retry or buffer (keep running and store it later)")
 )
 
+// storePolicy is parsed store-failure flag.
+var storePolicy job.StorePolicy
+
+var spec = component.JobSpec{
+	Name: "convert",
+	Tasks: []component.TaskSpec{
+		{Name: "low-res", Cmd: "convert-stream", Args: []string{"-r 420x280"}},
+		{Name: "mid-res", Cmd: "convert-stream", Args: []string{"-r 1280x720"}},
+		{
+			Name:      "hi-res",
+			Cmd:       "convert-stream",
+			Args:      []string{"-r 1920x1080"},
+			Labels:    map[string]string{"size": "large"},
+			Resources: component.Resources{CPU: 2, Memory: 512, Slots: 1},
+		},
+	},
+}
+
 func main() {
-	logger := log.New(os.Stderr, "", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	flag.Parse()
+	spec.Tenant, spec.Priority = *tenant, *priority
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runner: %v\n", err)
+		os.Exit(2)
+	}
+	logger := logging.New(os.Stderr, level)
+	if storePolicy, err = job.ParseStorePolicy(*storeFail); err != nil {
+		fmt.Fprintf(os.Stderr, "runner: %v\n", err)
+		os.Exit(2)
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				logger.Error("metrics endpoint failed", "error", err.Error())
+			}
+		}()
+	}
+
+	tracer, err := setupTracing()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runner: %v\n", err)
+		os.Exit(2)
+	}
+
+	// Continue trace of the parent process, if any
+	ctx := context.Background()
+	if sc, err := tracing.ParseTraceparent(os.Getenv(tracing.EnvVar)); err == nil {
+		ctx = tracing.WithRemoteParent(ctx, sc)
+	}
+
+	// Command given as argument takes precedence over mode flag, e.g. "runner -store ... store export"
+	cmd := *mode
+	var args []string
+	if flag.NArg() > 0 {
+		cmd, args = flag.Arg(0), flag.Args()[1:]
+	}
+	switch cmd {
+	case "local":
+		err = runLocal(ctx, logger)
+	case "coordinator":
+		err = runCoordinator(ctx, logger)
+	case "worker":
+		err = runWorker(ctx, logger)
+	case "queue":
+		err = showQueue()
+	case "list":
+		err = listRecords(ctx, logger)
+	case "gc":
+		err = collectGarbage(ctx, logger)
+	case "store":
+		err = storeCommand(ctx, logger, args)
+	default:
+		err = fmt.Errorf("unknown mode %q", cmd)
+	}
+
+	// Job state buffered while data store was failing is stored before exiting
+	fctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	if ferr := job.Flush(fctx); ferr != nil {
+		logger.Error("job state flush failed", "error", ferr.Error())
+		if err == nil || err == context.Canceled {
+			err = ferr
+		}
+	}
+	cancel()
+
+	// Data stores are closed once nothing writes to them, so that their pending writes are flushed
+	for _, s := range openedStores {
+		if cerr := s.Close(); cerr != nil {
+			logger.Error("closing store failed", "error", cerr.Error())
+			if err == nil || err == context.Canceled {
+				err = cerr
+			}
+		}
+	}
+
+	if tracer != nil {
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if serr := tracer.Shutdown(sctx); serr != nil {
+			logger.Error("trace export failed", "error", serr.Error())
+		}
+		cancel()
+	}
+
+	if err != nil && err != context.Canceled {
+		logger.Error("runner failed", "error", err.Error())
+		os.Exit(1)
+	}
+}
+
+// runLocal executes jobs in the current process.
+func runLocal(ctx context.Context, logger logging.Logger) error {
 	// Create store.Service
-	var storeService = memory.New()
+	storeService, err := openStore(ctx, logger)
+	if err != nil {
+		return err
+	}
+	var workspaces = newWorkspaces()
+
+	if *submit || *worker != "" {
+		shares, err := parseWeights(*weights)
+		if err != nil {
+			return err
+		}
+		q := queue.New(storeService, queue.WithTenantWeights(shares))
+		if *submit {
+			id, err := q.Submit(ctx, spec)
+			if err != nil {
+				return err
+			}
+			logger.Info("job submitted", "item", id)
+		}
+		if *worker != "" {
+			// Process queued jobs until interrupted
+			ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+			defer cancel()
+			startCollector(ctx, storeService, workspaces, logger)
+
+			return queue.NewWorker(*worker, q,
+				queue.WithLogger(logger),
+				queue.WithJobOptions(job.WithWorkspace(workspaces), job.WithStorePolicy(storePolicy)),
+			).Run(ctx)
+		}
+		return nil
+	}
+
+	if *schedule != "" {
+		// Run job periodically until interrupted
+		ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+		defer cancel()
+		startCollector(ctx, storeService, workspaces, logger)
+
+		sched := scheduler.New(storeService,
+			scheduler.WithLogger(logger),
+			scheduler.WithJobOptions(job.WithWorkspace(workspaces), job.WithStorePolicy(storePolicy)),
+		)
+		err := sched.Add(scheduler.Schedule{
+			ID:      spec.Name,
+			Expr:    *schedule,
+			Spec:    spec,
+			Overlap: scheduler.OverlapSkip,
+		})
+		if err != nil {
+			return err
+		}
+		return sched.Run(ctx)
+	}
+
 	// Create job component with tasks
-	var j = job.New(
-		storeService,
-		task.New("low-res", "convert-stream", "-r 420x280"),
-		task.New("mid-res", "convert-stream", "-r 1280x720"),
-		task.New("hi-res", "convert-stream", "-r 1920x1080"),
+	var tasks []component.Task
+	for _, ts := range spec.Tasks {
+		tasks = append(tasks, task.New(ts, task.WithLogger(logger)))
+	}
+	j, err := job.New(storeService, tasks,
+		job.WithSpec(spec),
+		job.WithWorkspace(workspaces),
+		job.WithStorePolicy(storePolicy),
+		job.WithLogger(logger),
 	)
+	if err != nil {
+		return err
+	}
 	// Create job's context
-	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, time.Second*4)
 	defer cancel()
 	// Execute job
-	err := j.Run(ctx)
+	return j.Run(ctx)
+}
+
+// runCoordinator serves workers and runs the job on them.
+func runCoordinator(ctx context.Context, logger logging.Logger) error {
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancel()
+
+	storeService, err := openStore(ctx, logger)
+	if err != nil {
+		return err
+	}
+	shares, err := parseWeights(*weights)
+	if err != nil {
+		return err
+	}
+	coord := cluster.NewCoordinator(storeService,
+		cluster.WithTenantWeights(shares),
+		cluster.WithLogger(logger),
+	)
+	startCollector(ctx, storeService, nil, logger)
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- coord.Serve(ctx, l)
+	}()
+
+	// Tasks are executed by workers, job itself runs here
+	var tasks []component.Task
+	for _, ts := range spec.Tasks {
+		tasks = append(tasks, coord.Task(ts))
+	}
+	j, err := job.New(storeService, tasks, job.WithSpec(spec), job.WithStorePolicy(storePolicy), job.WithLogger(logger))
+	if err != nil {
+		return err
+	}
+	if err := j.Run(ctx); err != nil {
+		return err
+	}
+
+	cancel()
+	return <-serveErr
+}
+
+// runWorker executes tasks assigned by coordinator until interrupted.
+func runWorker(ctx context.Context, logger logging.Logger) error {
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancel()
+
+	id := *worker
+	if id == "" {
+		host, _ := os.Hostname()
+		id = fmt.Sprintf("%v-%v", host, os.Getpid())
+	}
+	info := cluster.WorkerInfo{
+		ID:     id,
+		Labels: parseLabels(*labels),
+		CPU:    *cpu,
+		Memory: *mem,
+		Slots:  *slots,
+	}
+
+	return cluster.NewWorker(info, *addr, cluster.WithWorkerLogger(logger)).Run(ctx)
+}
+
+// setupTracing installs tracer exporting spans to configured destinations, it returns nil tracer
+// if tracing is disabled.
+func setupTracing() (*tracing.Tracer, error) {
+	var exporters []tracing.Exporter
+	if *traceFile != "" {
+		f, err := os.OpenFile(*traceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, tracing.NewFileExporter(f))
+	}
+	if *otlpAddr != "" {
+		exporters = append(exporters, tracing.NewOTLPExporter(*otlpAddr, "runner"))
+	}
+	if len(exporters) == 0 {
+		return nil, nil
+	}
+
+	tracer := tracing.NewTracer("runner", tracing.MultiExporter(exporters...))
+	tracing.SetDefault(tracer)
+	return tracer, nil
+}
+
+// showQueue prints tasks waiting at coordinator in dispatch order.
+func showQueue() error {
+	entries, err := cluster.FetchQueue(*addr)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		fmt.Printf("%d\t%v\t%v\t%v\t%d\t%v\n", e.Position, e.TaskID, e.Name, e.Tenant, e.Priority, e.Reason)
+	}
+	return nil
+}
+
+// listRecords prints stored records matching the flags, one per line.
+func listRecords(ctx context.Context, logger logging.Logger) error {
+	q := store.Query{
+		Kind:   *kind,
+		JobID:  *jobID,
+		Name:   *name,
+		Labels: parseLabels(*labels),
+		Cursor: *cursor,
+		Limit:  *limit,
+	}
+	for _, st := range strings.Split(*status, ",") {
+		if st = strings.TrimSpace(st); st != "" {
+			q.Status = append(q.Status, component.Status(st))
+		}
+	}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+
+	storeService, err := openStore(ctx, logger)
+	if err != nil {
+		return err
+	}
+	page, err := storeService.Find(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, rec := range page.Records {
+		s := store.Summarize(rec)
+		fmt.Printf("%v\t%v\t%v\t%v\t%v\n", rec.ID(), s.Kind, s.Name, s.Status, s.Created.Format(time.RFC3339))
+	}
+	if page.Next != "" {
+		fmt.Fprintf(os.Stderr, "more records follow, continue with -cursor %v\n", page.Next)
+	}
+	return nil
+}
+
+// collectGarbage removes job history which is out of retention and prints what was removed, one job per line.
+func collectGarbage(ctx context.Context, logger logging.Logger) error {
+	storeService, err := openStore(ctx, logger)
+	if err != nil {
+		return err
+	}
+	opts := []retention.Option{retention.WithWorkspaces(newWorkspaces()), retention.WithLogger(logger)}
+	if *dryRun {
+		opts = append(opts, retention.WithDryRun())
+	}
+	report, err := retention.New(storeService, retentionPolicy(), opts...).Collect(ctx)
+	for _, r := range report.Removals {
+		fmt.Printf("%v\t%v\t%v\t%d tasks\t%v\n", r.JobID, r.Name, r.Status, r.Tasks, r.Reason)
+	}
+	return err
+}
+
+// storeCommand manages data store: "export [file]" writes all records to file or standard output, "import [file]"
+// reads them from file or standard input.
+func storeCommand(ctx context.Context, logger logging.Logger, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: runner [flags] store export|import [file]")
+	}
+	storeService, err := openStore(ctx, logger)
 	if err != nil {
-		logger.Fatalf("runner: %v", err)
+		return err
+	}
+
+	switch args[0] {
+	case "export":
+		var w io.Writer = os.Stdout
+		var f *os.File
+		if len(args) == 2 {
+			if f, err = os.Create(args[1]); err != nil {
+				return err
+			}
+			w = f
+		}
+		n, err := store.Export(ctx, storeService, w)
+		// Export is complete only once created file is closed, standard output is left open
+		if f != nil {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		logging.Outcome(logger, err, "records exported", "records", n)
+		return err
+	case "import":
+		r := os.Stdin
+		if len(args) == 2 {
+			if r, err = os.Open(args[1]); err != nil {
+				return err
+			}
+			defer r.Close()
+		}
+		stats, err := store.Import(ctx, storeService, r)
+		logging.Outcome(logger, err, "records imported",
+			"created", stats.Created,
+			"updated", stats.Updated,
+			"unchanged", stats.Unchanged,
+		)
+		return err
+	}
+	return fmt.Errorf("unknown store command %q", args[0])
+}
+
+// startCollector removes job history out of retention in background, if retention is configured.
+func startCollector(ctx context.Context, s store.Service, workspaces *workspace.Manager, logger logging.Logger) {
+	policy := retentionPolicy()
+	if !policy.Enabled() {
+		return
+	}
+	opts := []retention.Option{retention.WithInterval(*gcInterval), retention.WithLogger(logger)}
+	if workspaces != nil {
+		opts = append(opts, retention.WithWorkspaces(workspaces))
+	}
+	go retention.New(s, policy, opts...).Run(ctx)
+}
+
+func retentionPolicy() retention.Policy {
+	return retention.Policy{KeepLast: *keepLast, Succeeded: *keepOK, Failed: *keepFailed}
+}
+
+// newWorkspaces creates workspace manager, failed job's files are kept for inspection.
+func newWorkspaces() *workspace.Manager {
+	return workspace.New(
+		filepath.Join(os.TempDir(), "runner"),
+		workspace.CleanupOnSuccess,
+		workspace.WithPerTask(),
+	)
+}
+
+// openedStores are data stores opened by the command, they are closed before the process exits.
+var openedStores []store.Service
+
+// openStore opens data store service, cached if enabled. Cache stops watching data store when context is
+// cancelled.
+func openStore(ctx context.Context, logger logging.Logger) (store.Service, error) {
+	s, err := store.Open(*storeURL, logger)
+	if err != nil {
+		return nil, err
+	}
+	openedStores = append(openedStores, s)
+	if *cacheSize <= 0 {
+		return s, nil
+	}
+	return cache.New(ctx, s, cache.WithSize(*cacheSize), cache.WithTTL(*cacheTTL), cache.WithLogger(logger)), nil
+}
+
+// parseWeights parses comma separated tenant=weight pairs.
+func parseWeights(s string) (map[string]int, error) {
+	res := make(map[string]int)
+	for t, w := range parseLabels(s) {
+		n, err := strconv.Atoi(w)
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight of tenant %q: %v", t, err)
+		}
+		res[t] = n
+	}
+	return res, nil
+}
+
+// parseLabels parses comma separated key=value pairs, a key without value is treated as "true".
+func parseLabels(s string) map[string]string {
+	res := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		if i := strings.Index(kv, "="); i >= 0 {
+			res[kv[:i]] = kv[i+1:]
+		} else {
+			res[kv] = "true"
+		}
 	}
+	return res
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+)
+
+func TestStoreExport(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "export.jsonl")
+	tests := []struct {
+		name string
+		args []string
+		// read returns written export
+		read func(stdout *os.File) (string, error)
+	}{
+		{
+			name: "stdout",
+			args: []string{"export"},
+			read: func(stdout *os.File) (string, error) {
+				data, err := os.ReadFile(stdout.Name())
+				return string(data), err
+			},
+		},
+		{
+			name: "file",
+			args: []string{"export", file},
+			read: func(*os.File) (string, error) {
+				data, err := os.ReadFile(file)
+				return string(data), err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stdout.Close()
+			saved := os.Stdout
+			os.Stdout = stdout
+			defer func() { os.Stdout = saved }()
+
+			if err := storeCommand(context.Background(), logging.Discard(), tt.args); err != nil {
+				t.Fatal(err)
+			}
+			data, err := tt.read(stdout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(data, `"format":"`+store.ExportFormat+`"`) {
+				t.Errorf("export = %q, want header", data)
+			}
+
+			// Standard output stays open for whatever follows
+			if _, err := stdout.WriteString("done\n"); err != nil {
+				t.Errorf("writing to standard output after export: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package component
+
+import "context"
+
+type jobIDKey struct{}
+
+// WithJobID returns context of tasks executed on behalf of the job with provided id.
+func WithJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey{}, id)
+}
+
+// JobIDFromContext returns id of the job executing the task, if there is one.
+func JobIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(jobIDKey{}).(string)
+	return id, ok && id != ""
+}
@@ -2,92 +2,275 @@ package job
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/fairshare"
 	"github.com/caelifer/runner/service/generator"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/metrics"
 	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/tracing"
+	"github.com/caelifer/runner/service/workspace"
 )
 
 var timeout = 5 * time.Second
 
+var (
+	jobsStarted   = metrics.NewCounter("runner_jobs_started_total", "Number of started jobs.")
+	jobsSucceeded = metrics.NewCounter("runner_jobs_succeeded_total", "Number of succeeded jobs.")
+	jobsFailed    = metrics.NewCounter("runner_jobs_failed_total", "Number of failed jobs.")
+	taskDuration  = metrics.NewHistogram(
+		"runner_task_duration_seconds",
+		"Duration of task execution by task name and outcome.",
+		nil,
+		"name", "status",
+	)
+)
+
 type job struct {
-	id      string
-	tasks   []component.Task
-	success bool
-	text    string
-	store   store.Service
-	logger  *log.Logger
+	id        string
+	schedule  string
+	spec      component.JobSpec
+	tasks     []component.Task
+	lifecycle *component.Lifecycle
+	text      string
+	store     store.Service
+	workspace *workspace.Manager
+	logger    logging.Logger
+	policy    StorePolicy
+
+	// revs keeps revisions of written job and task records, buffered keeps records which failed to be written
+	mu       sync.Mutex
+	revs     map[string]int64
+	buffered map[string]store.Record
+}
+
+// recorder is implemented by tasks which are able to describe their complete state, nil record means
+// task is unable to do so.
+type recorder interface {
+	Record() *store.TaskRecord
+}
+
+// Option configures optional job parameters.
+type Option func(*job)
+
+// WithWorkspace makes job run its tasks inside dedicated workspace created by provided manager.
+func WithWorkspace(m *workspace.Manager) Option {
+	return func(j *job) {
+		j.workspace = m
+	}
+}
+
+// WithScheduleID records id of the schedule which triggered the job.
+func WithScheduleID(id string) Option {
+	return func(j *job) {
+		j.schedule = id
+	}
+}
+
+// WithSpec records spec job was created from, including its tenant and priority.
+func WithSpec(spec component.JobSpec) Option {
+	return func(j *job) {
+		j.spec = spec
+	}
+}
+
+// WithTenant sets job's owner.
+func WithTenant(tenant string) Option {
+	return func(j *job) {
+		j.spec.Tenant = tenant
+	}
 }
 
-type logRec struct {
-	Component string `json:"component"`
-	ID        string `json:"id"`
-	Status    string `json:"status"`
-	Success   bool   `json:"success,omitempty"`
-	Error     string `json:"error,omitempty"`
-	Duration  string `json:"duration,omitempty"`
+// WithPriority sets job's priority among other jobs of the same tenant.
+func WithPriority(priority int) Option {
+	return func(j *job) {
+		j.spec.Priority = priority
+	}
 }
 
-func (l logRec) String() string {
-	out, _ := json.Marshal(&l)
-	return string(out)
+// WithLogger sets job's logger.
+func WithLogger(l logging.Logger) Option {
+	return func(j *job) {
+		j.logger = l
+	}
 }
 
-func New(store store.Service, tasks ...component.Task) *job {
+// New creates job running provided tasks and persists it. Error is returned if the job can not be persisted,
+// unless its store failure policy keeps it running.
+func New(storeService store.Service, tasks []component.Task, opts ...Option) (*job, error) {
 	j := &job{
-		id:     generator.NewID(),
-		tasks:  tasks,
-		store:  store,
-		logger: log.New(os.Stderr, "", log.Ldate|log.Lmicroseconds|log.Lshortfile),
+		id:        generator.NewID(),
+		tasks:     tasks,
+		lifecycle: component.NewLifecycle(),
+		store:     storeService,
+		revs:      make(map[string]int64),
+		buffered:  make(map[string]store.Record),
+		logger:    logging.Default(),
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	j.logger = j.logger.With("component", "job", "job_id", j.id)
+	if j.policy == StoreRetry {
+		j.store = store.Use(j.store, store.Retry(storeRetries, storeRetryBackoff, retryable))
 	}
 
-	_ = j.store.Create(j)
+	// Job is recorded together with all its tasks, so that none of them is missing after a crash
+	recs := []store.Record{j.Record()}
+	for _, t := range j.tasks {
+		recs = append(recs, j.taskRecord(t))
+	}
+	if err := j.persist(context.Background(), recs...); err != nil {
+		return nil, fmt.Errorf("job %v: persisting state: %v", j.id, err)
+	}
 
-	return j
+	return j, nil
 }
 
 func (j *job) ID() string {
 	return j.id
 }
 
+// ScheduleID returns id of the schedule which triggered the job, or empty string for ad hoc jobs.
+func (j *job) ScheduleID() string {
+	return j.schedule
+}
+
+// Tenant returns job's owner.
+func (j *job) Tenant() string {
+	return j.spec.Tenant
+}
+
+// Priority returns job's priority.
+func (j *job) Priority() int {
+	return j.spec.Priority
+}
+
+// Success reports whether job finished successfully.
 func (j *job) Success() bool {
-	return j.success
+	return j.lifecycle.Status() == component.StatusSucceeded
+}
+
+// Status returns job's lifecycle status.
+func (j *job) Status() component.Status {
+	return j.lifecycle.Status()
+}
+
+// Record returns snapshot of job's state to be persisted.
+func (j *job) Record() *store.JobRecord {
+	rec := &store.JobRecord{
+		JobID:      j.id,
+		Name:       j.spec.Name,
+		ScheduleID: j.schedule,
+		Tenant:     j.spec.Tenant,
+		Priority:   j.spec.Priority,
+		Spec:       j.spec,
+		Meta: store.Meta{
+			Status:     j.lifecycle.Status(),
+			History:    j.lifecycle.History(),
+			CreatedAt:  j.lifecycle.Created(),
+			StartedAt:  j.lifecycle.Started(),
+			FinishedAt: j.lifecycle.Finished(),
+			Attempts:   j.lifecycle.Attempts(),
+			Error:      j.text,
+			SpecHash:   j.spec.Hash(),
+		},
+	}
+	for _, t := range j.tasks {
+		rec.TaskIDs = append(rec.TaskIDs, t.ID())
+	}
+	return rec
+}
+
+// taskRecord returns snapshot of task's state to be persisted.
+func (j *job) taskRecord(t component.Task) *store.TaskRecord {
+	var rec *store.TaskRecord
+	if r, ok := t.(recorder); ok {
+		rec = r.Record()
+	}
+	if rec == nil {
+		rec = &store.TaskRecord{TaskID: t.ID(), Name: t.Name(), ExitCode: -1}
+		rec.Status = t.Status()
+	}
+	rec.JobID = j.id
+	return rec
 }
 
 func (j *job) Run(ctx context.Context) (err error) {
+	if err = j.lifecycle.To(component.StatusRunning); err != nil {
+		return fmt.Errorf("job %v: %v", j.id, err)
+	}
+
+	ctx, span := tracing.Start(ctx, "job.run",
+		"job.id", j.id,
+		"job.name", j.spec.Name,
+		"job.tenant", j.spec.Tenant,
+		"job.priority", j.spec.Priority,
+	)
 	defer func(t0 time.Time) {
-		errStr := ""
-		if err != nil {
-			errStr = err.Error()
+		status := component.Outcome(ctx, err)
+		_ = j.lifecycle.To(status)
+
+		// Update persistent state of the job and its tasks at once, even if the job was cancelled
+		recs := []store.Record{j.Record()}
+		for _, t := range j.tasks {
+			recs = append(recs, j.taskRecord(t))
 		}
-		j.logger.Printf("%v",
-			logRec{
-				Component: "job",
-				ID:        j.id,
-				Status:    "finished",
-				Success:   j.success,
-				Error:     errStr,
-				Duration:  fmt.Sprintf("%v", time.Since(t0)),
-			},
+		if serr := j.persist(context.WithoutCancel(ctx), recs...); serr != nil && err == nil {
+			err = fmt.Errorf("job %v: persisting state: %v", j.id, serr)
+		}
+		j.replay()
+
+		span.SetAttribute("job.status", string(status))
+		span.End(err)
+		if err == nil && status == component.StatusSucceeded {
+			jobsSucceeded.With().Inc()
+		} else {
+			jobsFailed.With().Inc()
+		}
+		logging.Outcome(j.logger, err, "job finished",
+			"status", status,
+			"duration_ms", logging.DurationMs(time.Since(t0)),
 		)
 	}(time.Now())
 
-	j.logger.Printf("%v",
-		logRec{
-			Component: "job",
-			ID:        j.id,
-			Status:    "started",
-		},
-	)
+	j.logger.Info("job started")
+	jobsStarted.With().Inc()
+	if err = j.persist(ctx, j.Record()); err != nil {
+		err = fmt.Errorf("job %v: persisting state: %v", j.id, err)
+		for _, task := range j.tasks {
+			_ = task.Skip()
+		}
+		return
+	}
+
+	// Prepare job's workspace
+	var ws *workspace.Workspace
+	if j.workspace != nil {
+		if ws, err = j.workspace.Create(j.id); err != nil {
+			j.text = fmt.Sprintf("workspace: %v", err)
+			err = fmt.Errorf("job %v failed: %v", j.id, j.text)
+			// None of the tasks is going to run
+			for _, task := range j.tasks {
+				_ = task.Skip()
+			}
+			return
+		}
+		defer func() {
+			if rerr := ws.Release(err == nil); rerr != nil && err == nil {
+				err = fmt.Errorf("job %v: workspace cleanup: %v", j.id, rerr)
+			}
+		}()
+	}
 
-	j.success = true // assume all is going to be well
+	// Let shared executors know who owns the tasks
+	ctx = fairshare.NewContext(ctx, fairshare.Class{Tenant: j.spec.Tenant, Priority: j.spec.Priority})
+	ctx = component.WithJobID(ctx, j.id)
 
 	var res = make(chan result, len(j.tasks))
 	var wg sync.WaitGroup
@@ -95,15 +278,42 @@ func (j *job) Run(ctx context.Context) (err error) {
 	wg.Add(len(j.tasks))
 	for _, task := range j.tasks {
 		task := task
-		_ = j.store.Create(task)
 		go func() {
 			defer wg.Done()
 
 			ctx, cancel := context.WithTimeout(ctx, timeout)
 			defer cancel()
 
-			err := task.Execute(ctx)
-			_ = j.store.Update(task.ID(), task)
+			// Each attempt to execute the task gets its own span
+			ctx, span := tracing.Start(ctx, "task.execute", "task.id", task.ID(), "task.name", task.Name())
+			var err error
+			defer func() {
+				span.End(err)
+			}()
+
+			tws, err := j.taskWorkspace(ws, task)
+			if err != nil {
+				err = fmt.Errorf("workspace: %v", err)
+				_ = task.Skip()
+				if serr := j.persist(ctx, j.taskRecord(task)); serr != nil {
+					err = fmt.Errorf("%v, persisting state: %v", err, serr)
+				}
+				res <- result{task.Name(), err}
+				return
+			}
+			if tws != nil {
+				ctx = workspace.NewContext(ctx, tws.Dir())
+			}
+
+			t0 := time.Now()
+			err = task.Execute(ctx)
+			taskDuration.With(task.Name(), string(task.Status())).Observe(time.Since(t0).Seconds())
+			if tws != nil && tws != ws {
+				_ = tws.Release(err == nil)
+			}
+			if serr := j.persist(ctx, j.taskRecord(task)); serr != nil && err == nil {
+				err = fmt.Errorf("persisting state: %v", serr)
+			}
 			res <- result{task.Name(), err}
 		}()
 	}
@@ -116,7 +326,6 @@ func (j *job) Run(ctx context.Context) (err error) {
 	var txt []string
 	for r := range res {
 		if r.err != nil {
-			j.success = false
 			txt = append(txt, fmt.Sprintf("task '%v' failed: %v",
 				r.tsk,
 				r.err,
@@ -124,17 +333,61 @@ func (j *job) Run(ctx context.Context) (err error) {
 		}
 	}
 
-	// Update persistent state
 	j.text = strings.Join(txt, ", ")
-	_ = j.store.Update(j.id, j)
-
-	if !j.success {
+	if len(txt) > 0 {
 		err = fmt.Errorf("job %v failed: %v", j.id, j.text)
 	}
 
 	return
 }
 
+// create atomically persists new records.
+func (j *job) create(ctx context.Context, recs ...store.Record) error {
+	tx, err := j.store.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	tx.Create(recs...)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	j.track(recs...)
+	return nil
+}
+
+// saveAll atomically persists changed records. Task records are also written by shared executors, e.g.
+// coordinator assigning remote task, so conflicting changes are resolved in favour of the more advanced state.
+func (j *job) saveAll(ctx context.Context, recs ...store.Record) error {
+	j.mu.Lock()
+	for _, rec := range recs {
+		rec.SetRevision(j.revs[rec.ID()])
+	}
+	j.mu.Unlock()
+
+	err := store.SaveAll(ctx, j.store, recs, store.KeepNewer)
+	if err == nil {
+		j.track(recs...)
+	}
+	return err
+}
+
+// track remembers revisions of written records.
+func (j *job) track(recs ...store.Record) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, rec := range recs {
+		j.revs[rec.ID()] = rec.Revision()
+	}
+}
+
+// taskWorkspace returns workspace task should run in, or nil if job has none.
+func (j *job) taskWorkspace(ws *workspace.Workspace, task component.Task) (*workspace.Workspace, error) {
+	if ws == nil || !j.workspace.PerTask() {
+		return ws, nil
+	}
+	return ws.Sub(task.ID())
+}
+
 type result struct {
 	tsk string
 	err error
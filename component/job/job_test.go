@@ -0,0 +1,239 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/generator"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/memory"
+)
+
+// fakeTask succeeds right away.
+type fakeTask struct {
+	id        string
+	name      string
+	lifecycle *component.Lifecycle
+}
+
+func newFakeTask(name string) *fakeTask {
+	return &fakeTask{id: generator.NewID(), name: name, lifecycle: component.NewLifecycle()}
+}
+
+func (t *fakeTask) Execute(ctx context.Context) error {
+	if err := t.lifecycle.To(component.StatusRunning); err != nil {
+		return err
+	}
+	return t.lifecycle.To(component.StatusSucceeded)
+}
+
+func (t *fakeTask) Name() string             { return t.name }
+func (t *fakeTask) ID() string               { return t.id }
+func (t *fakeTask) Success() bool            { return t.Status() == component.StatusSucceeded }
+func (t *fakeTask) Status() component.Status { return t.lifecycle.Status() }
+func (t *fakeTask) Skip() error              { return t.lifecycle.To(component.StatusSkipped) }
+
+// faultyStore is a data store whose writes fail while it is down, or the given number of times.
+type faultyStore struct {
+	store.Service
+
+	mu       sync.Mutex
+	down     bool
+	failures int
+	err      error
+}
+
+func newFaultyStore(err error) *faultyStore {
+	fs := &faultyStore{err: err}
+	fs.Service = store.Use(memory.New(memory.WithLogger(logging.Discard())), fs.middleware)
+	return fs
+}
+
+func (fs *faultyStore) middleware(ctx context.Context, op *store.Operation, next func(ctx context.Context) error) error {
+	switch op.Name {
+	case "create", "update", "delete", "commit":
+		fs.mu.Lock()
+		fail, err := fs.down || fs.failures > 0, fs.err
+		if fs.failures > 0 {
+			fs.failures--
+		}
+		fs.mu.Unlock()
+		if fail {
+			return err
+		}
+	}
+	return next(ctx)
+}
+
+func (fs *faultyStore) set(down bool, failures int) {
+	fs.mu.Lock()
+	fs.down, fs.failures = down, failures
+	fs.mu.Unlock()
+}
+
+func (fs *faultyStore) setErr(err error) {
+	fs.mu.Lock()
+	fs.err = err
+	fs.mu.Unlock()
+}
+
+var errUnavailable = &store.Error{Backend: "test", Transient: true, Err: errors.New("connection refused")}
+
+// status returns persisted status of the job.
+func status(t *testing.T, s store.Service, id string) component.Status {
+	t.Helper()
+	rec, err := s.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.(*store.JobRecord).Status
+}
+
+func TestNewStorePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   StorePolicy
+		err      error
+		down     bool
+		failures int
+		fails    bool
+	}{
+		{"fail", StoreFail, errUnavailable, false, 1, true},
+		{"retry recovers", StoreRetry, errUnavailable, false, 1, false},
+		{"retry permanent failure", StoreRetry, store.ErrAlreadyExists, false, 1, true},
+		{"buffer", StoreBuffer, errUnavailable, true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFaultyStore(tt.err)
+			fs.set(tt.down, tt.failures)
+			j, err := New(fs, []component.Task{newFakeTask("t")}, WithStorePolicy(tt.policy), WithLogger(logging.Discard()))
+			if tt.fails {
+				if err == nil || !strings.Contains(err.Error(), "persisting state") {
+					t.Fatalf("New() = %v, want persisting error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Buffered state is written with the next write
+			fs.set(false, 0)
+			if err := j.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if s := status(t, fs, j.ID()); s != component.StatusSucceeded {
+				t.Errorf("persisted status %v, want %v", s, component.StatusSucceeded)
+			}
+		})
+	}
+}
+
+func TestRunStorePolicy(t *testing.T) {
+	tests := []struct {
+		policy StorePolicy
+		fails  bool
+		task   component.Status
+	}{
+		{StoreFail, true, component.StatusSkipped},
+		{StoreBuffer, false, component.StatusSucceeded},
+	}
+	for _, tt := range tests {
+		fs := newFaultyStore(errUnavailable)
+		task := newFakeTask("t")
+		j, err := New(fs, []component.Task{task}, WithStorePolicy(tt.policy), WithLogger(logging.Discard()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fs.set(true, 0)
+		err = j.Run(context.Background())
+		if (err != nil) != tt.fails {
+			t.Errorf("%v: Run() = %v, want failure %v", tt.policy, err, tt.fails)
+		}
+		if task.Status() != tt.task {
+			t.Errorf("%v: task is %v, want %v", tt.policy, task.Status(), tt.task)
+		}
+		if tt.fails {
+			continue
+		}
+
+		// State buffered when job finished is replayed in the background
+		fs.set(false, 0)
+		deadline := time.Now().Add(5 * time.Second)
+		for status(t, fs, j.ID()) != component.StatusSucceeded {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v: buffered state was not replayed", tt.policy)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	// Job state of every store is buffered when the job finishes
+	var stores []*faultyStore
+	var jobs []*job
+	for i := 0; i < 3; i++ {
+		fs := newFaultyStore(errUnavailable)
+		j, err := New(fs, []component.Task{newFakeTask("t")}, WithStorePolicy(StoreBuffer), WithLogger(logging.Discard()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.set(true, 0)
+		if err := j.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		stores, jobs = append(stores, fs), append(jobs, j)
+	}
+	recovered, broken, down := stores[0], stores[1], stores[2]
+	recovered.set(false, 0)
+	broken.setErr(store.ErrConflict)
+
+	tests := []struct {
+		name string
+		// recover is called before flush
+		recover func()
+		err     string
+	}{
+		{"store down", func() {}, "still buffered"},
+		{"store recovered", func() { down.set(false, 0) }, "dropped"},
+	}
+	for _, tt := range tests {
+		tt.recover()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := Flush(ctx)
+		cancel()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: Flush() = %v, want %q error", tt.name, err, tt.err)
+		}
+	}
+
+	// Records failing permanently are dropped, others are stored by the time Flush returns
+	for _, i := range []int{0, 2} {
+		if s := status(t, stores[i], jobs[i].ID()); s != component.StatusSucceeded {
+			t.Errorf("persisted status of job %d is %v, want %v", i, s, component.StatusSucceeded)
+		}
+	}
+	if s := status(t, broken, jobs[1].ID()); s == component.StatusSucceeded {
+		t.Errorf("persisted status of dropped job is %v", s)
+	}
+}
+
+func TestParseStorePolicy(t *testing.T) {
+	for _, p := range []StorePolicy{StoreFail, StoreRetry, StoreBuffer} {
+		if got, err := ParseStorePolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParseStorePolicy(%q) = %v, %v", p, got, err)
+		}
+	}
+	if _, err := ParseStorePolicy("ignore"); err == nil {
+		t.Error("ParseStorePolicy(ignore) succeeded")
+	}
+}
@@ -0,0 +1,260 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/service/metrics"
+	"github.com/caelifer/runner/service/store"
+)
+
+// StorePolicy defines what happens when job fails to persist its state.
+type StorePolicy int
+
+// Supported store failure policies.
+const (
+	// StoreFail fails the job.
+	StoreFail StorePolicy = iota
+	// StoreRetry retries failed writes with backoff, the job fails if they keep failing.
+	StoreRetry
+	// StoreBuffer keeps the job running, failed writes are buffered and replayed with the next write; those
+	// still failing when the job finishes are replayed in the background until they succeed or fail
+	// permanently. Flush waits for background replays.
+	StoreBuffer
+)
+
+var storePolicies = map[StorePolicy]string{
+	StoreFail:   "fail",
+	StoreRetry:  "retry",
+	StoreBuffer: "buffer",
+}
+
+func (p StorePolicy) String() string {
+	return storePolicies[p]
+}
+
+// ParseStorePolicy parses store failure policy name: fail, retry or buffer.
+func ParseStorePolicy(s string) (StorePolicy, error) {
+	for p, name := range storePolicies {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown store failure policy %q", s)
+}
+
+// Retry and replay backoff.
+const (
+	storeRetries      = 5
+	storeRetryBackoff = 500 * time.Millisecond
+	maxReplayBackoff  = time.Minute
+)
+
+var storeFailures = metrics.NewCounter("runner_job_store_failures_total", "Number of failed writes of job state by store failure policy.", "policy")
+
+// WithStorePolicy sets what happens when job fails to persist its state, by default the job fails.
+func WithStorePolicy(p StorePolicy) Option {
+	return func(j *job) {
+		j.policy = p
+	}
+}
+
+// retryable reports whether failed write may succeed when retried: it failed neither because of state of
+// records nor permanently.
+func retryable(err error) bool {
+	var serr *store.Error
+	if errors.As(err, &serr) {
+		return serr.Transient
+	}
+	switch err {
+	case store.ErrNotFound, store.ErrAlreadyExists, store.ErrConflict, context.Canceled, context.DeadlineExceeded:
+		return false
+	}
+	return true
+}
+
+// persist writes records according to store failure policy, error is returned if the job should fail.
+func (j *job) persist(ctx context.Context, recs ...store.Record) error {
+	if j.policy == StoreBuffer {
+		recs = j.unbuffer(recs)
+	}
+	err := j.write(ctx, recs...)
+	if err == nil {
+		return nil
+	}
+	storeFailures.With(j.policy.String()).Inc()
+	if j.policy != StoreBuffer {
+		return err
+	}
+
+	j.buffer(recs)
+	j.logger.Warn("job state buffered", "records", len(recs), "error", err.Error())
+	return nil
+}
+
+// write persists records, those which were never written are created; others are saved atomically, resolving
+// conflicts like saveAll does.
+func (j *job) write(ctx context.Context, recs ...store.Record) error {
+	var created, saved []store.Record
+	j.mu.Lock()
+	for _, rec := range recs {
+		if _, ok := j.revs[rec.ID()]; ok {
+			saved = append(saved, rec)
+		} else {
+			created = append(created, rec)
+		}
+	}
+	j.mu.Unlock()
+
+	if len(created) > 0 {
+		if err := j.create(ctx, created...); err != nil {
+			return err
+		}
+	}
+	if len(saved) > 0 {
+		return j.saveAll(ctx, saved...)
+	}
+	return nil
+}
+
+// buffer keeps records which failed to be written, unless newer state of them is already buffered.
+func (j *job) buffer(recs []store.Record) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, rec := range recs {
+		if _, ok := j.buffered[rec.ID()]; !ok {
+			j.buffered[rec.ID()] = rec
+		}
+	}
+}
+
+// unbuffer takes buffered records to be written together with provided ones, which are newer.
+func (j *job) unbuffer(recs []store.Record) []store.Record {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, rec := range recs {
+		delete(j.buffered, rec.ID())
+	}
+	for id, rec := range j.buffered {
+		recs = append(recs, rec)
+		delete(j.buffered, id)
+	}
+	return recs
+}
+
+// replays tracks background replays of buffered job state, so that process can wait for them before it exits.
+var replays = struct {
+	sync.Mutex
+	wg sync.WaitGroup
+	// jobs are jobs being replayed, dropped is number of records which failed to be written permanently
+	jobs    map[*job]struct{}
+	dropped int
+	// flush is closed once Flush is called, replays stop backing off
+	flush     chan struct{}
+	flushOnce sync.Once
+}{
+	jobs:  make(map[*job]struct{}),
+	flush: make(chan struct{}),
+}
+
+// Flush waits until job state buffered by StoreBuffer policy is replayed, it retries pending writes without
+// waiting out their backoff. Error is returned if some records failed to be written permanently, or are
+// still buffered when context is cancelled. Process should call it before it exits.
+func Flush(ctx context.Context) error {
+	replays.flushOnce.Do(func() {
+		close(replays.flush)
+	})
+	done := make(chan struct{})
+	go func() {
+		replays.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	replays.Lock()
+	defer replays.Unlock()
+	buffered := 0
+	for j := range replays.jobs {
+		j.mu.Lock()
+		buffered += len(j.buffered)
+		j.mu.Unlock()
+	}
+	switch {
+	case buffered > 0:
+		return fmt.Errorf("job state not stored: %d records still buffered: %v", buffered, err)
+	case replays.dropped > 0:
+		return fmt.Errorf("job state not stored: %d records dropped", replays.dropped)
+	}
+	return nil
+}
+
+// replay writes buffered records in the background until it succeeds, or fails permanently and the records
+// are dropped.
+func (j *job) replay() {
+	j.mu.Lock()
+	n := len(j.buffered)
+	j.mu.Unlock()
+	if n == 0 {
+		return
+	}
+
+	j.logger.Warn("job state replay started", "records", n)
+	replays.Lock()
+	replays.jobs[j] = struct{}{}
+	replays.wg.Add(1)
+	replays.Unlock()
+	go func() {
+		defer func() {
+			replays.Lock()
+			delete(replays.jobs, j)
+			replays.Unlock()
+			replays.wg.Done()
+		}()
+
+		flush := replays.flush
+		backoff := storeRetryBackoff
+		for {
+			t := time.NewTimer(backoff)
+			select {
+			case <-t.C:
+			case <-flush:
+				// Process is about to exit, records are written right away and then without growing backoff
+				t.Stop()
+				flush = nil
+			}
+
+			recs := j.unbuffer(nil)
+			err := j.write(context.Background(), recs...)
+			if err == nil {
+				j.logger.Info("job state replayed", "records", len(recs))
+				return
+			}
+			if !retryable(err) {
+				ids := make([]string, 0, len(recs))
+				for _, rec := range recs {
+					ids = append(ids, rec.ID())
+				}
+				j.logger.Error("job state dropped", "records", len(recs), "ids", ids, "error", err.Error())
+				replays.Lock()
+				replays.dropped += len(recs)
+				replays.Unlock()
+				return
+			}
+			j.buffer(recs)
+			if flush == nil {
+				backoff = storeRetryBackoff
+			} else if backoff *= 2; backoff > maxReplayBackoff {
+				backoff = maxReplayBackoff
+			}
+		}
+	}()
+}
@@ -0,0 +1,175 @@
+package component
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Status is a lifecycle status of a job or task.
+type Status string
+
+// Lifecycle statuses.
+const (
+	// StatusPending is a status of created job or task which has not been started yet.
+	StatusPending Status = "pending"
+	// StatusQueued is a status of task waiting for a shared executor.
+	StatusQueued Status = "queued"
+	// StatusRunning is a status of job or task being executed.
+	StatusRunning Status = "running"
+	// StatusSucceeded is a terminal status of successfully executed job or task.
+	StatusSucceeded Status = "succeeded"
+	// StatusFailed is a status of job or task whose execution failed.
+	StatusFailed Status = "failed"
+	// StatusCancelled is a terminal status of job or task whose execution was cancelled.
+	StatusCancelled Status = "cancelled"
+	// StatusSkipped is a terminal status of task which was never executed.
+	StatusSkipped Status = "skipped"
+	// StatusTimedOut is a status of job or task which did not finish in time.
+	StatusTimedOut Status = "timed_out"
+	// StatusRetrying is a status of task being prepared for another execution attempt.
+	StatusRetrying Status = "retrying"
+)
+
+// transitions lists statuses each status may be changed to.
+var transitions = map[Status][]Status{
+	StatusPending:   {StatusQueued, StatusRunning, StatusCancelled, StatusSkipped},
+	StatusQueued:    {StatusRunning, StatusCancelled, StatusSkipped, StatusTimedOut},
+	StatusRunning:   {StatusSucceeded, StatusFailed, StatusCancelled, StatusTimedOut, StatusRetrying},
+	StatusRetrying:  {StatusQueued, StatusRunning, StatusCancelled, StatusSkipped, StatusTimedOut},
+	StatusFailed:    {StatusRetrying},
+	StatusTimedOut:  {StatusRetrying},
+	StatusSucceeded: nil,
+	StatusCancelled: nil,
+	StatusSkipped:   nil,
+}
+
+// Exported errors.
+var (
+	// ErrInvalidTransition error is returned when status can't be changed to requested one.
+	ErrInvalidTransition = errors.New("invalid status transition")
+)
+
+// CanTransition reports whether status s may be changed to status to.
+func (s Status) CanTransition(to Status) bool {
+	for _, t := range transitions[s] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Finished reports whether status marks the end of an execution attempt.
+func (s Status) Finished() bool {
+	switch s {
+	case StatusSucceeded, StatusFailed, StatusCancelled, StatusSkipped, StatusTimedOut:
+		return true
+	}
+	return false
+}
+
+// Outcome returns status execution attempt ended with, given its error and context it was executed in.
+func Outcome(ctx context.Context, err error) Status {
+	switch {
+	case err == nil:
+		return StatusSucceeded
+	case ctx.Err() == context.DeadlineExceeded:
+		return StatusTimedOut
+	case ctx.Err() == context.Canceled:
+		return StatusCancelled
+	}
+	return StatusFailed
+}
+
+// Transition records when status was entered.
+type Transition struct {
+	Status Status    `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+// Lifecycle tracks status of a job or task and validates its changes. It is safe for concurrent use.
+type Lifecycle struct {
+	mu      sync.Mutex
+	history []Transition
+}
+
+// NewLifecycle creates lifecycle in pending status.
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{history: []Transition{{Status: StatusPending, At: time.Now()}}}
+}
+
+// Status returns current status.
+func (l *Lifecycle) Status() Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current().Status
+}
+
+// To changes current status. ErrInvalidTransition is returned if the change is not allowed.
+func (l *Lifecycle) To(s Status) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	from := l.current().Status
+	if !from.CanTransition(s) {
+		return fmt.Errorf("%w: %v -> %v", ErrInvalidTransition, from, s)
+	}
+	l.history = append(l.history, Transition{Status: s, At: time.Now()})
+	return nil
+}
+
+// History returns all transitions in order, starting with creation.
+func (l *Lifecycle) History() []Transition {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Transition(nil), l.history...)
+}
+
+// Created returns creation time.
+func (l *Lifecycle) Created() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.history[0].At
+}
+
+// Started returns time latest execution attempt started, or zero time if there was none.
+func (l *Lifecycle) Started() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.history) - 1; i >= 0; i-- {
+		if l.history[i].Status == StatusRunning {
+			return l.history[i].At
+		}
+	}
+	return time.Time{}
+}
+
+// Finished returns time latest execution attempt finished, or zero time if it is still in progress.
+func (l *Lifecycle) Finished() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c := l.current(); c.Status.Finished() {
+		return c.At
+	}
+	return time.Time{}
+}
+
+// Attempts returns number of started execution attempts.
+func (l *Lifecycle) Attempts() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, t := range l.history {
+		if t.Status == StatusRunning {
+			n++
+		}
+	}
+	return n
+}
+
+func (l *Lifecycle) current() Transition {
+	return l.history[len(l.history)-1]
+}
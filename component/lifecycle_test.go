@@ -0,0 +1,86 @@
+package component
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLifecycleTransitions(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     []Status
+		invalid  Status
+		attempts int
+		finished bool
+	}{
+		{"success", []Status{StatusRunning, StatusSucceeded}, "", 1, true},
+		{"queued", []Status{StatusQueued, StatusRunning, StatusFailed}, "", 1, true},
+		{"retried", []Status{StatusRunning, StatusFailed, StatusRetrying, StatusRunning, StatusSucceeded}, "", 2, true},
+		{"timed out retry", []Status{StatusRunning, StatusTimedOut, StatusRetrying, StatusQueued}, "", 1, false},
+		{"skipped", []Status{StatusSkipped}, "", 0, true},
+		{"pending to succeeded", nil, StatusSucceeded, 0, false},
+		{"pending to retrying", nil, StatusRetrying, 0, false},
+		{"succeeded is terminal", []Status{StatusRunning, StatusSucceeded}, StatusRetrying, 1, true},
+		{"cancelled is terminal", []Status{StatusCancelled}, StatusRunning, 0, true},
+		{"failed to running", []Status{StatusRunning, StatusFailed}, StatusRunning, 1, true},
+		{"running to running", []Status{StatusRunning}, StatusRunning, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLifecycle()
+			for _, s := range tt.path {
+				if err := l.To(s); err != nil {
+					t.Fatalf("To(%v) failed: %v", s, err)
+				}
+			}
+			if tt.invalid != "" {
+				before := l.Status()
+				if err := l.To(tt.invalid); !errors.Is(err, ErrInvalidTransition) {
+					t.Fatalf("To(%v) from %v = %v, want ErrInvalidTransition", tt.invalid, before, err)
+				}
+				if s := l.Status(); s != before {
+					t.Fatalf("status changed by invalid transition to %v", s)
+				}
+			}
+
+			if n := len(l.History()); n != len(tt.path)+1 {
+				t.Errorf("history has %d transitions, want %d", n, len(tt.path)+1)
+			}
+			if n := l.Attempts(); n != tt.attempts {
+				t.Errorf("Attempts() = %d, want %d", n, tt.attempts)
+			}
+			if f := !l.Finished().IsZero(); f != tt.finished {
+				t.Errorf("finished = %v, want %v", f, tt.finished)
+			}
+			if started := !l.Started().IsZero(); started != (tt.attempts > 0) {
+				t.Errorf("started = %v with %d attempts", started, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	failure := errors.New("failure")
+
+	tests := []struct {
+		ctx  context.Context
+		err  error
+		want Status
+	}{
+		{context.Background(), nil, StatusSucceeded},
+		{context.Background(), failure, StatusFailed},
+		{cancelled, nil, StatusSucceeded},
+		{cancelled, failure, StatusCancelled},
+		{expired, failure, StatusTimedOut},
+	}
+	for _, tt := range tests {
+		if got := Outcome(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("Outcome(%v, %v) = %v, want %v", tt.ctx.Err(), tt.err, got, tt.want)
+		}
+	}
+}
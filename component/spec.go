@@ -0,0 +1,75 @@
+package component
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// TaskSpec describes a task to be created, independently of any particular execution.
+type TaskSpec struct {
+	Name string   `json:"name"`
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args,omitempty"`
+	// Labels must all be present on a worker for the task to be placed on it.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Resources requested by the task while it runs.
+	Resources Resources `json:"resources,omitempty"`
+}
+
+// Resources describes amount of compute resources, either requested by task or offered by worker.
+type Resources struct {
+	// CPU is number of CPUs.
+	CPU int `json:"cpu,omitempty"`
+	// Memory in MiB.
+	Memory int64 `json:"memory,omitempty"`
+	// Slots is number of concurrently running tasks.
+	Slots int `json:"slots,omitempty"`
+}
+
+// IsZero reports whether no resources are specified.
+func (r Resources) IsZero() bool {
+	return r == Resources{}
+}
+
+// Fits reports whether r fits into available resources.
+func (r Resources) Fits(available Resources) bool {
+	return r.CPU <= available.CPU && r.Memory <= available.Memory && r.Slots <= available.Slots
+}
+
+// Add returns sum of resources.
+func (r Resources) Add(o Resources) Resources {
+	return Resources{CPU: r.CPU + o.CPU, Memory: r.Memory + o.Memory, Slots: r.Slots + o.Slots}
+}
+
+// Sub returns difference of resources.
+func (r Resources) Sub(o Resources) Resources {
+	return Resources{CPU: r.CPU - o.CPU, Memory: r.Memory - o.Memory, Slots: r.Slots - o.Slots}
+}
+
+// JobSpec describes a job as a named set of tasks.
+type JobSpec struct {
+	Name  string     `json:"name"`
+	Tasks []TaskSpec `json:"tasks"`
+	// Tenant owns the job, shared executors are divided fairly between tenants.
+	Tenant string `json:"tenant,omitempty"`
+	// Priority orders jobs of the same tenant, higher values go first.
+	Priority int `json:"priority,omitempty"`
+}
+
+// Hash returns digest of task spec, tasks created from identical specs have identical hashes.
+func (s TaskSpec) Hash() string {
+	return hash(s)
+}
+
+// Hash returns digest of job spec, jobs created from identical specs have identical hashes.
+func (s JobSpec) Hash() string {
+	return hash(s)
+}
+
+// hash returns hex encoded SHA-256 of v's JSON encoding, which is stable since map keys are sorted.
+func hash(v interface{}) string {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
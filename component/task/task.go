@@ -2,17 +2,21 @@ package task
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/caelifer/runner/component"
 	"github.com/caelifer/runner/service/generator"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/tracing"
+	"github.com/caelifer/runner/service/workspace"
 )
 
 func init() {
@@ -20,55 +24,72 @@ func init() {
 }
 
 type task struct {
-	id     string
-	name   string
-	cmd    string
-	args   []string
-	err    error
-	logger *log.Logger
-}
+	id        string
+	name      string
+	cmd       string
+	args      []string
+	spec      component.TaskSpec
+	lifecycle *component.Lifecycle
+	logger    logging.Logger
 
-type logrec struct {
-	Component string `json:"component"`
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Operation string `json:"operation"`
-	Cmd       string `json:"cmd"`
-	Error     string `json:"error,omitempty"`
-	Duration  string `json:"duration"`
+	mu       sync.Mutex
+	jobID    string
+	exitCode int
+	err      error
 }
 
-func (l logrec) String() string {
-	out, _ := json.Marshal(&l)
-	return string(out)
+// Option configures optional task parameters.
+type Option func(*task)
+
+// WithLogger sets task's logger.
+func WithLogger(l logging.Logger) Option {
+	return func(t *task) {
+		t.logger = l
+	}
 }
 
-func New(name string, cmd string, args ...string) *task {
-	return &task{
-		id:     generator.NewID(),
-		name:   name,
-		cmd:    cmd,
-		args:   args,
-		logger: log.New(os.Stderr, "", log.Ldate|log.Lmicroseconds|log.Lshortfile),
+func New(spec component.TaskSpec, opts ...Option) *task {
+	t := &task{
+		id:        generator.NewID(),
+		name:      spec.Name,
+		cmd:       spec.Cmd,
+		args:      spec.Args,
+		spec:      spec,
+		lifecycle: component.NewLifecycle(),
+		logger:    logging.Default(),
+		exitCode:  -1,
 	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.logger = t.logger.With("component", "task", "task_id", t.id, "name", t.name)
+	return t
 }
 
 func (t *task) Execute(ctx context.Context) (err error) {
-	defer func(t0 time.Time) {
-		errStr := ""
-		if err != nil {
-			errStr = err.Error()
+	// Failed task may be executed again
+	if s := t.lifecycle.Status(); s == component.StatusFailed || s == component.StatusTimedOut {
+		if err = t.lifecycle.To(component.StatusRetrying); err != nil {
+			return
 		}
-		t.logger.Printf("%v",
-			logrec{
-				Component: "task",
-				ID:        t.id,
-				Name:      t.name,
-				Operation: "execute",
-				Cmd:       strings.Join(append([]string{t.cmd}, t.args...), " "),
-				Error:     errStr,
-				Duration:  fmt.Sprintf("%v", time.Since(t0)),
-			},
+	}
+	if err = t.lifecycle.To(component.StatusRunning); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	if id, ok := component.JobIDFromContext(ctx); ok {
+		t.jobID = id
+	}
+	t.exitCode = -1
+	t.err = nil
+	t.mu.Unlock()
+
+	defer func(t0 time.Time) {
+		logging.Outcome(t.logger, err, "task executed",
+			"cmd", strings.Join(append([]string{t.cmd}, t.args...), " "),
+			"status", t.lifecycle.Status(),
+			"duration_ms", logging.DurationMs(time.Since(t0)),
 		)
 	}(time.Now())
 
@@ -78,6 +99,17 @@ func (t *task) Execute(ctx context.Context) (err error) {
 	cmd := exec.CommandContext(ctx, "sleep", pause)
 	// Use our own STDERR for task's diagnostic messages
 	cmd.Stderr = os.Stderr
+	// Run inside job's workspace if one was provided
+	var env []string
+	if dir, ok := workspace.FromContext(ctx); ok {
+		cmd.Dir = dir
+		env = append(env, workspace.EnvVar+"="+dir)
+	}
+	// Let the command continue current trace
+	env = append(env, tracing.Environ(ctx)...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	// Run external command
 	if err = cmd.Run(); err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
@@ -86,7 +118,13 @@ func (t *task) Execute(ctx context.Context) (err error) {
 	}
 
 	// Update state
+	t.mu.Lock()
 	t.err = err
+	if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
+		t.exitCode = cmd.ProcessState.ExitCode()
+	}
+	t.mu.Unlock()
+	_ = t.lifecycle.To(component.Outcome(ctx, err))
 
 	return
 }
@@ -104,6 +142,44 @@ func (t *task) ID() string {
 	return t.id
 }
 
+// Success reports whether task was executed successfully.
 func (t *task) Success() bool {
-	return t.err == nil
+	return t.lifecycle.Status() == component.StatusSucceeded
+}
+
+// Status returns task's lifecycle status.
+func (t *task) Status() component.Status {
+	return t.lifecycle.Status()
+}
+
+// Skip marks task which is not going to be executed.
+func (t *task) Skip() error {
+	return t.lifecycle.To(component.StatusSkipped)
+}
+
+// Record returns snapshot of task's state to be persisted.
+func (t *task) Record() *store.TaskRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rec := &store.TaskRecord{
+		TaskID:   t.id,
+		JobID:    t.jobID,
+		Name:     t.name,
+		Spec:     t.spec,
+		ExitCode: t.exitCode,
+		Meta: store.Meta{
+			Status:     t.lifecycle.Status(),
+			History:    t.lifecycle.History(),
+			CreatedAt:  t.lifecycle.Created(),
+			StartedAt:  t.lifecycle.Started(),
+			FinishedAt: t.lifecycle.Finished(),
+			Attempts:   t.lifecycle.Attempts(),
+			SpecHash:   t.spec.Hash(),
+		},
+	}
+	if t.err != nil {
+		rec.Error = t.err.Error()
+	}
+	return rec
 }
@@ -7,4 +7,8 @@ type Task interface {
 	Name() string
 	ID() string
 	Success() bool
+	// Status returns task's lifecycle status.
+	Status() Status
+	// Skip marks task which is not going to be executed.
+	Skip() error
 }
@@ -0,0 +1,18 @@
+package cluster
+
+import "net/rpc"
+
+// FetchQueue returns tasks waiting for a worker at coordinator listening on provided address, in dispatch order.
+func FetchQueue(addr string) ([]QueueEntry, error) {
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var reply QueueReply
+	if err := client.Call(serviceName+".Queue", &QueueArgs{}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Entries, nil
+}
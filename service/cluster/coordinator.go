@@ -0,0 +1,488 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/fairshare"
+	"github.com/caelifer/runner/service/generator"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/metrics"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/tracing"
+)
+
+// DefaultWorkerTimeout is how long coordinator waits for worker's poll before it considers worker gone
+// and reassigns its tasks.
+const DefaultWorkerTimeout = 15 * time.Second
+
+var (
+	pendingTasks = metrics.NewGauge("runner_coordinator_pending_tasks", "Number of tasks waiting for a worker.")
+	taskRetries  = metrics.NewCounter("runner_coordinator_task_retries_total", "Number of tasks reassigned after their worker was lost.")
+)
+
+// maxPollWait caps how long single poll call may block.
+const maxPollWait = DefaultWorkerTimeout / 3
+
+// Coordinator assigns tasks to registered workers and collects their results.
+type Coordinator struct {
+	store         store.Service
+	workerTimeout time.Duration
+	weights       map[string]int
+	logger        logging.Logger
+
+	mu      sync.Mutex
+	workers map[string]*workerState
+	pending *fairshare.Queue
+	running map[string]*assignment
+	wake    chan struct{}
+	// unsaved are states of tasks changed while c.mu is held, they are persisted once it's released
+	unsaved []snapshot
+}
+
+// workerState is coordinator's view of registered worker.
+type workerState struct {
+	info      WorkerInfo
+	lastSeen  time.Time
+	running   map[string]*assignment
+	used      component.Resources
+	cancelled []string
+}
+
+// assignment tracks remote task from submission till completion.
+type assignment struct {
+	// ctx is remote task's execution context, it carries trace of the job
+	ctx    context.Context
+	task   *remoteTask
+	entry  *fairshare.Entry
+	worker string
+	result chan error
+	// seq numbers snapshots of task's state, it is guarded by coordinator's lock
+	seq int64
+
+	// mu serializes writes of task's state: saved is the latest snapshot written and rev is revision of task
+	// record it was written at
+	mu    sync.Mutex
+	saved int64
+	rev   int64
+}
+
+// snapshot is a copy of task's state taken under coordinator's lock to be persisted after it's released.
+type snapshot struct {
+	a   *assignment
+	seq int64
+	rec *store.TaskRecord
+}
+
+// Option configures Coordinator.
+type Option func(*Coordinator)
+
+// WithTenantWeights sets tenants' shares of the worker pool, tenants not listed have weight 1.
+func WithTenantWeights(weights map[string]int) Option {
+	return func(c *Coordinator) {
+		c.weights = weights
+	}
+}
+
+// WithLogger sets coordinator's logger.
+func WithLogger(l logging.Logger) Option {
+	return func(c *Coordinator) {
+		c.logger = l
+	}
+}
+
+// NewCoordinator creates new coordinator. Task state reported by workers is persisted in provided data store.
+func NewCoordinator(store store.Service, opts ...Option) *Coordinator {
+	c := &Coordinator{
+		store:         store,
+		workerTimeout: DefaultWorkerTimeout,
+		logger:        logging.Default(),
+		workers:       make(map[string]*workerState),
+		running:       make(map[string]*assignment),
+		wake:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.pending = fairshare.New(c.weights)
+	c.logger = c.logger.With("component", "coordinator")
+	return c
+}
+
+// Task creates task which is executed by one of the workers.
+func (c *Coordinator) Task(spec component.TaskSpec) component.Task {
+	return &remoteTask{
+		id:        generator.NewID(),
+		spec:      spec,
+		c:         c,
+		lifecycle: component.NewLifecycle(),
+		exitCode:  -1,
+	}
+}
+
+// Workers returns currently registered workers.
+func (c *Coordinator) Workers() []WorkerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	workers := make([]WorkerInfo, 0, len(c.workers))
+	for _, w := range c.workers {
+		workers = append(workers, w.info)
+	}
+	return workers
+}
+
+// Pending returns tasks waiting for a worker in dispatch order.
+func (c *Coordinator) Pending() []QueueEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	order := c.pending.Order()
+	entries := make([]QueueEntry, 0, len(order))
+	for i, e := range order {
+		a := e.Value.(*assignment)
+		entries = append(entries, QueueEntry{
+			TaskID:   a.task.id,
+			Name:     a.task.spec.Name,
+			Tenant:   e.Class.Tenant,
+			Priority: e.Class.Priority,
+			Position: i + 1,
+			Reason:   a.task.Reason(),
+		})
+	}
+	return entries
+}
+
+// Serve accepts worker connections on provided listener until context is cancelled.
+func (c *Coordinator) Serve(ctx context.Context, l net.Listener) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(serviceName, &rpcService{c}); err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	go c.reap(ctx)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// reap periodically removes workers which stopped polling and reassigns their tasks.
+func (c *Coordinator) reap(ctx context.Context) {
+	ticker := time.NewTicker(c.workerTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		deadline := time.Now().Add(-c.workerTimeout)
+		for id, w := range c.workers {
+			if w.lastSeen.After(deadline) {
+				continue
+			}
+			c.log("worker-lost", id, "", nil)
+			for _, a := range w.running {
+				c.requeue(w, a)
+			}
+			delete(c.workers, id)
+		}
+		c.updateReasons()
+		c.broadcast()
+		c.unlock()
+	}
+}
+
+// register adds worker or refreshes its capabilities. Tasks assigned to re-registering worker which it no
+// longer runs, e.g. because it restarted, are reassigned.
+func (c *Coordinator) register(info WorkerInfo, running []string) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if w, ok := c.workers[info.ID]; ok {
+		keep := make(map[string]bool, len(running))
+		for _, id := range running {
+			keep[id] = true
+		}
+		for id, a := range w.running {
+			if !keep[id] {
+				c.requeue(w, a)
+			}
+		}
+		w.info = info
+		w.lastSeen = time.Now()
+	} else {
+		c.workers[info.ID] = &workerState{
+			info:     info,
+			lastSeen: time.Now(),
+			running:  make(map[string]*assignment),
+		}
+	}
+	c.log("worker-registered", info.ID, "", nil)
+	c.updateReasons()
+	c.broadcast()
+}
+
+// requeue takes task away from the worker and queues it for reassignment, must be called with c.mu held.
+func (c *Coordinator) requeue(w *workerState, a *assignment) {
+	c.log("task-requeued", w.info.ID, a.task.id, nil)
+	w.release(a)
+	delete(c.running, a.task.id)
+	a.worker = ""
+	a.task.setWorker("")
+	c.pending.Requeue(a.entry)
+	taskRetries.With().Inc()
+}
+
+// poll hands out pending tasks to the worker, waiting for them up to provided duration.
+func (c *Coordinator) poll(workerID string, wait time.Duration, reply *PollReply) error {
+	if wait > maxPollWait {
+		wait = maxPollWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	c.mu.Lock()
+	defer c.unlock()
+
+	for {
+		w, ok := c.workers[workerID]
+		if !ok {
+			return ErrUnknownWorker
+		}
+		w.lastSeen = time.Now()
+
+		reply.Cancelled, w.cancelled = w.cancelled, nil
+		for _, e := range c.pending.Order() {
+			a := e.Value.(*assignment)
+			if !w.fits(a.task.spec) {
+				continue
+			}
+			c.pending.Start(e)
+			c.assign(a, w)
+			reply.Assignments = append(reply.Assignments, Assignment{
+				TaskID:      a.task.id,
+				Spec:        a.task.spec,
+				Traceparent: tracing.Traceparent(a.ctx),
+			})
+		}
+		pendingTasks.With().Set(float64(c.pending.Len()))
+		if len(reply.Assignments) > 0 || len(reply.Cancelled) > 0 {
+			return nil
+		}
+
+		wake := c.wake
+		c.unlock()
+		select {
+		case <-wake:
+			c.mu.Lock()
+		case <-timer.C:
+			c.mu.Lock()
+			return nil
+		}
+	}
+}
+
+// assign binds pending task to the worker, must be called with c.mu held.
+func (c *Coordinator) assign(a *assignment, w *workerState) {
+	a.worker = w.info.ID
+	w.running[a.task.id] = a
+	w.used = w.used.Add(request(a.task.spec))
+	c.running[a.task.id] = a
+
+	a.task.setWorker(w.info.ID)
+	a.task.setReason("")
+	c.changed(a)
+	c.log("task-assigned", w.info.ID, a.task.id, nil)
+}
+
+// changed takes snapshot of task's state to be persisted once c.mu is released, must be called with c.mu held.
+func (c *Coordinator) changed(a *assignment) {
+	a.seq++
+	c.unsaved = append(c.unsaved, snapshot{a: a, seq: a.seq, rec: a.task.Record()})
+}
+
+// unlock releases c.mu and persists states of tasks changed while it was held, so that slow data store does
+// not block workers.
+func (c *Coordinator) unlock() {
+	unsaved := c.unsaved
+	c.unsaved = nil
+	c.mu.Unlock()
+
+	for _, s := range unsaved {
+		_ = s.save(c.store)
+	}
+}
+
+// save persists task's state unless a later snapshot was already written. Task record is also written by the
+// job task belongs to, conflicting changes are resolved in favour of the more advanced state.
+func (s snapshot) save(st store.Service) error {
+	a := s.a
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if s.seq <= a.saved {
+		return nil
+	}
+	s.rec.SetRevision(a.rev)
+	err := store.Save(a.ctx, st, s.rec, store.KeepNewer(s.rec))
+	a.rev = s.rec.Revision()
+	if err == nil {
+		a.saved = s.seq
+	}
+	return err
+}
+
+// report delivers task's outcome to the job waiting for it.
+func (c *Coordinator) report(args *ReportArgs) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a, ok := c.running[args.TaskID]
+	if !ok || a.worker != args.WorkerID {
+		// Stale report for reassigned or cancelled task
+		return
+	}
+	delete(c.running, args.TaskID)
+	c.pending.Finish(a.entry)
+	if w, ok := c.workers[args.WorkerID]; ok {
+		w.release(a)
+	}
+
+	var err error
+	if args.Error != "" {
+		err = errors.New(args.Error)
+	}
+	a.task.setExitCode(args.ExitCode)
+	a.result <- err
+	c.broadcast()
+}
+
+// submit queues remote task for assignment.
+func (c *Coordinator) submit(ctx context.Context, t *remoteTask) <-chan error {
+	a := &assignment{ctx: ctx, task: t, result: make(chan error, 1)}
+	a.entry = &fairshare.Entry{ID: t.id, Class: fairshare.FromContext(ctx), Value: a}
+
+	c.mu.Lock()
+	c.pending.Push(a.entry)
+	c.updateReasons()
+	c.broadcast()
+	c.unlock()
+
+	return a.result
+}
+
+// cancel withdraws remote task, worker running it is told to abandon it.
+func (c *Coordinator) cancel(taskID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending.Remove(taskID) {
+		pendingTasks.With().Set(float64(c.pending.Len()))
+		return
+	}
+	if a, ok := c.running[taskID]; ok {
+		delete(c.running, taskID)
+		c.pending.Finish(a.entry)
+		if w, ok := c.workers[a.worker]; ok {
+			w.release(a)
+			w.cancelled = append(w.cancelled, taskID)
+		}
+		c.broadcast()
+	}
+}
+
+// updateReasons explains why pending tasks are not running yet, must be called with c.mu held.
+func (c *Coordinator) updateReasons() {
+	for _, e := range c.pending.Order() {
+		a := e.Value.(*assignment)
+		reason := ReasonNoEligibleWorker
+		for _, w := range c.workers {
+			if eligible(w.info, a.task.spec) {
+				reason = ReasonInsufficientResources
+				break
+			}
+		}
+		if a.task.setReason(reason) {
+			c.changed(a)
+			c.logger.Info("task pending", "event", "task-pending", "task_id", a.task.id, "reason", reason)
+		}
+	}
+}
+
+// release returns resources held by finished or withdrawn assignment.
+func (w *workerState) release(a *assignment) {
+	if _, ok := w.running[a.task.id]; ok {
+		delete(w.running, a.task.id)
+		w.used = w.used.Sub(request(a.task.spec))
+	}
+}
+
+// broadcast wakes up all blocked polls, must be called with c.mu held.
+func (c *Coordinator) broadcast() {
+	pendingTasks.With().Set(float64(c.pending.Len()))
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+func (c *Coordinator) log(event, worker, taskID string, err error) {
+	args := []interface{}{"event", event}
+	if worker != "" {
+		args = append(args, "worker", worker)
+	}
+	if taskID != "" {
+		args = append(args, "task_id", taskID)
+	}
+	logging.Outcome(c.logger, err, "coordinator "+event, args...)
+}
+
+// rpcService exposes coordinator's methods to workers.
+type rpcService struct {
+	c *Coordinator
+}
+
+// Register registers worker with coordinator.
+func (s *rpcService) Register(args *RegisterArgs, _ *RegisterReply) error {
+	if args.Worker.ID == "" {
+		return errors.New("worker id is required")
+	}
+	s.c.register(args.Worker, args.Running)
+	return nil
+}
+
+// Poll returns tasks assigned to the worker.
+func (s *rpcService) Poll(args *PollArgs, reply *PollReply) error {
+	return s.c.poll(args.WorkerID, args.Wait, reply)
+}
+
+// Queue returns tasks waiting for a worker in dispatch order.
+func (s *rpcService) Queue(_ *QueueArgs, reply *QueueReply) error {
+	reply.Entries = s.c.Pending()
+	return nil
+}
+
+// Report records outcome of the assigned task.
+func (s *rpcService) Report(args *ReportArgs, _ *ReportReply) error {
+	s.c.report(args)
+	return nil
+}
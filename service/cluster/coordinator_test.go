@@ -0,0 +1,319 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/memory"
+)
+
+// serve starts coordinator on a local port and returns its address.
+func serve(t *testing.T, c *Coordinator) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go c.Serve(ctx, l)
+	return l.Addr().String()
+}
+
+// dial connects fake worker to coordinator.
+func dial(t *testing.T, addr string) *rpc.Client {
+	t.Helper()
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// execute runs task in background, its outcome is sent to returned channel.
+func execute(ctx context.Context, task component.Task) <-chan error {
+	res := make(chan error, 1)
+	go func() {
+		res <- task.Execute(ctx)
+	}()
+	return res
+}
+
+func poll(t *testing.T, client *rpc.Client, worker string) PollReply {
+	t.Helper()
+	var reply PollReply
+	if err := client.Call(serviceName+".Poll", &PollArgs{WorkerID: worker, Wait: time.Second}, &reply); err != nil {
+		t.Fatalf("Poll() failed: %v", err)
+	}
+	return reply
+}
+
+func outcome(t *testing.T, res <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("task did not finish")
+	}
+	return nil
+}
+
+func TestCoordinatorRPC(t *testing.T) {
+	c := NewCoordinator(memory.New())
+	client := dial(t, serve(t, c))
+
+	var reply PollReply
+	err := client.Call(serviceName+".Poll", &PollArgs{WorkerID: "w1"}, &reply)
+	if err == nil || err.Error() != ErrUnknownWorker.Error() {
+		t.Fatalf("Poll() of unregistered worker = %v, want %v", err, ErrUnknownWorker)
+	}
+	if err := client.Call(serviceName+".Register", &RegisterArgs{Worker: WorkerInfo{ID: "w1", CPU: 1}}, &RegisterReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		report string
+	}{
+		{"succeeds", ""},
+		{"fails", "exit status 1"},
+	}
+	for _, tt := range tests {
+		res := execute(context.Background(), c.Task(component.TaskSpec{Name: tt.name}))
+		reply := poll(t, client, "w1")
+		if len(reply.Assignments) != 1 || reply.Assignments[0].Spec.Name != tt.name {
+			t.Fatalf("Poll() = %+v, want %v assigned", reply, tt.name)
+		}
+		args := &ReportArgs{WorkerID: "w1", TaskID: reply.Assignments[0].TaskID, Error: tt.report}
+		if err := client.Call(serviceName+".Report", args, &ReportReply{}); err != nil {
+			t.Fatal(err)
+		}
+
+		err := outcome(t, res)
+		if tt.report == "" && err != nil || tt.report != "" && (err == nil || err.Error() != tt.report) {
+			t.Errorf("%v: Execute() = %v, want %q", tt.name, err, tt.report)
+		}
+	}
+}
+
+func TestCoordinatorCapacity(t *testing.T) {
+	c := NewCoordinator(memory.New())
+	client := dial(t, serve(t, c))
+	if err := client.Call(serviceName+".Register", &RegisterArgs{Worker: WorkerInfo{ID: "w1", CPU: 1}}, &RegisterReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res := execute(ctx, c.Task(component.TaskSpec{Name: "first"}))
+	reply := poll(t, client, "w1")
+	if len(reply.Assignments) != 1 {
+		t.Fatalf("Poll() assigned %d tasks, want 1", len(reply.Assignments))
+	}
+	running := reply.Assignments[0].TaskID
+
+	// Worker with single CPU gets no more tasks until the running one is done
+	execute(context.Background(), c.Task(component.TaskSpec{Name: "second"}))
+	if reply := poll(t, client, "w1"); len(reply.Assignments) != 0 {
+		t.Fatalf("Poll() of busy worker assigned %+v", reply.Assignments)
+	}
+
+	// Cancelled task is withdrawn from its worker, which then gets the next one
+	cancel()
+	if err := outcome(t, res); err != context.Canceled {
+		t.Fatalf("Execute() = %v, want %v", err, context.Canceled)
+	}
+	reply = poll(t, client, "w1")
+	if len(reply.Cancelled) != 1 || reply.Cancelled[0] != running {
+		t.Errorf("Poll() cancelled %v, want [%v]", reply.Cancelled, running)
+	}
+	if len(reply.Assignments) != 1 || reply.Assignments[0].Spec.Name != "second" {
+		t.Errorf("Poll() assigned %+v, want second", reply.Assignments)
+	}
+}
+
+func TestWorker(t *testing.T) {
+	if testing.Short() {
+		t.Skip("executes a task")
+	}
+	c := NewCoordinator(memory.New())
+	addr := serve(t, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewWorker(WorkerInfo{ID: "w1"}, addr).Run(ctx)
+	}()
+
+	res := execute(ctx, c.Task(component.TaskSpec{Name: "task", Cmd: "true"}))
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Fatalf("task failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("task did not finish")
+	}
+	if ws := c.Workers(); len(ws) != 1 || ws[0].ID != "w1" || ws[0].CPU != 1 {
+		t.Errorf("Workers() = %+v, want w1 with 1 CPU", ws)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestReregister(t *testing.T) {
+	c := NewCoordinator(memory.New())
+	client := dial(t, serve(t, c))
+	register := func(running ...string) {
+		t.Helper()
+		args := &RegisterArgs{Worker: WorkerInfo{ID: "w1", CPU: 1}, Running: running}
+		if err := client.Call(serviceName+".Register", args, &RegisterReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	register()
+
+	res := execute(context.Background(), c.Task(component.TaskSpec{Name: "task"}))
+	reply := poll(t, client, "w1")
+	if len(reply.Assignments) != 1 {
+		t.Fatalf("Poll() assigned %d tasks, want 1", len(reply.Assignments))
+	}
+	id := reply.Assignments[0].TaskID
+
+	tests := []struct {
+		running  []string
+		assigned int
+	}{
+		// Worker reconnected and still runs the task
+		{[]string{id}, 0},
+		// Worker restarted and lost the task, it is assigned again
+		{nil, 1},
+	}
+	for _, tt := range tests {
+		register(tt.running...)
+		reply := poll(t, client, "w1")
+		if len(reply.Assignments) != tt.assigned || tt.assigned > 0 && reply.Assignments[0].TaskID != id {
+			t.Errorf("Poll() after registering with %v assigned %+v, want %d", tt.running, reply.Assignments, tt.assigned)
+		}
+	}
+
+	args := &ReportArgs{WorkerID: "w1", TaskID: id}
+	if err := client.Call(serviceName+".Report", args, &ReportReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := outcome(t, res); err != nil {
+		t.Errorf("Execute() = %v", err)
+	}
+}
+
+// blockingWrites holds writes to data store until it is opened, entered receives operation of every held write.
+type blockingWrites struct {
+	entered chan string
+	open    chan struct{}
+}
+
+func (b *blockingWrites) middleware(ctx context.Context, op *store.Operation, next func(ctx context.Context) error) error {
+	switch op.Name {
+	case "create", "update", "commit":
+		select {
+		case b.entered <- op.Name:
+		default:
+		}
+		<-b.open
+	}
+	return next(ctx)
+}
+
+func TestSlowStore(t *testing.T) {
+	b := &blockingWrites{entered: make(chan string, 1), open: make(chan struct{})}
+	c := NewCoordinator(store.Use(memory.New(memory.WithLogger(logging.Discard())), b.middleware), WithLogger(logging.Discard()))
+	client := dial(t, serve(t, c))
+	if err := client.Call(serviceName+".Register", &RegisterArgs{Worker: WorkerInfo{ID: "w1", CPU: 1}}, &RegisterReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pending task's state is written while it's submitted
+	res := execute(context.Background(), c.Task(component.TaskSpec{Name: "task"}))
+	select {
+	case <-b.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task state was not written")
+	}
+
+	// Workers are served meanwhile
+	done := make(chan struct{})
+	go func() {
+		c.Workers()
+		c.Pending()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("coordinator is blocked by data store write")
+	}
+
+	close(b.open)
+	reply := poll(t, client, "w1")
+	if len(reply.Assignments) != 1 {
+		t.Fatalf("Poll() assigned %d tasks, want 1", len(reply.Assignments))
+	}
+	args := &ReportArgs{WorkerID: "w1", TaskID: reply.Assignments[0].TaskID}
+	if err := client.Call(serviceName+".Report", args, &ReportReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := outcome(t, res); err != nil {
+		t.Errorf("Execute() = %v", err)
+	}
+}
+
+func TestSnapshotOrder(t *testing.T) {
+	ctx := context.Background()
+	s := memory.New(memory.WithLogger(logging.Discard()))
+	task := NewCoordinator(s, WithLogger(logging.Discard())).Task(component.TaskSpec{Name: "task"}).(*remoteTask)
+	// Job records its tasks first
+	rec := task.Record()
+	if err := s.Create(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	a := &assignment{ctx: ctx, task: task, rev: rec.Revision()}
+	take := func(worker string) snapshot {
+		task.setWorker(worker)
+		a.seq++
+		return snapshot{a: a, seq: a.seq, rec: task.Record()}
+	}
+	pending, assigned := take(""), take("w1")
+
+	// Snapshots written out of order leave the latest state stored
+	tests := []struct {
+		snap   snapshot
+		worker string
+	}{
+		{assigned, "w1"},
+		{pending, "w1"},
+	}
+	for _, tt := range tests {
+		if err := tt.snap.save(s); err != nil {
+			t.Fatal(err)
+		}
+		rec, err := s.Get(ctx, task.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.(*store.TaskRecord).Worker; got != tt.worker {
+			t.Errorf("after saving snapshot %d stored worker %q, want %q", tt.snap.seq, got, tt.worker)
+		}
+	}
+}
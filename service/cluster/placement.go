@@ -0,0 +1,45 @@
+package cluster
+
+import "github.com/caelifer/runner/component"
+
+// Reasons for task to stay pending.
+const (
+	// ReasonNoEligibleWorker means none of registered workers has required labels and capacity.
+	ReasonNoEligibleWorker = "no eligible worker"
+	// ReasonInsufficientResources means eligible workers exist, but all of them are busy.
+	ReasonInsufficientResources = "waiting for resources"
+)
+
+// request returns resources task needs while it runs, every task takes at least one slot.
+func request(spec component.TaskSpec) component.Resources {
+	r := spec.Resources
+	if r.Slots == 0 {
+		r.Slots = 1
+	}
+	return r
+}
+
+// capacity returns total resources worker offers.
+func capacity(info WorkerInfo) component.Resources {
+	slots := info.Slots
+	if slots < 1 {
+		slots = info.CPU
+	}
+	return component.Resources{CPU: info.CPU, Memory: info.Memory, Slots: slots}
+}
+
+// eligible reports whether task could ever run on the worker: worker has all required labels and enough
+// total capacity.
+func eligible(info WorkerInfo, spec component.TaskSpec) bool {
+	for k, v := range spec.Labels {
+		if wv, ok := info.Labels[k]; !ok || wv != v {
+			return false
+		}
+	}
+	return request(spec).Fits(capacity(info))
+}
+
+// fits reports whether task can run on the worker right now.
+func (w *workerState) fits(spec component.TaskSpec) bool {
+	return eligible(w.info, spec) && request(spec).Fits(capacity(w.info).Sub(w.used))
+}
@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/store/memory"
+)
+
+func TestFits(t *testing.T) {
+	gpu := WorkerInfo{ID: "w1", Labels: map[string]string{"gpu": "yes"}, CPU: 4, Memory: 1024}
+	tests := []struct {
+		name     string
+		spec     component.TaskSpec
+		used     component.Resources
+		eligible bool
+		fits     bool
+	}{
+		{"default request", component.TaskSpec{}, component.Resources{}, true, true},
+		{"matching label", component.TaskSpec{Labels: map[string]string{"gpu": "yes"}}, component.Resources{}, true, true},
+		{"label value differs", component.TaskSpec{Labels: map[string]string{"gpu": "no"}}, component.Resources{}, false, false},
+		{"missing label", component.TaskSpec{Labels: map[string]string{"zone": "a"}}, component.Resources{}, false, false},
+		{"exceeds capacity", component.TaskSpec{Resources: component.Resources{Memory: 2048}}, component.Resources{}, false, false},
+		{"fits capacity", component.TaskSpec{Resources: component.Resources{CPU: 4, Memory: 1024}}, component.Resources{}, true, true},
+		{"capacity in use", component.TaskSpec{Resources: component.Resources{CPU: 2}}, component.Resources{CPU: 3, Slots: 1}, true, false},
+		// Slots default to number of CPUs
+		{"no free slot", component.TaskSpec{}, component.Resources{Slots: 4}, true, false},
+		{"resource request takes a slot", component.TaskSpec{Resources: component.Resources{CPU: 1}}, component.Resources{Slots: 4}, true, false},
+	}
+	for _, tt := range tests {
+		w := &workerState{info: gpu, used: tt.used}
+		if got := eligible(gpu, tt.spec); got != tt.eligible {
+			t.Errorf("%v: eligible() = %v, want %v", tt.name, got, tt.eligible)
+		}
+		if got := w.fits(tt.spec); got != tt.fits {
+			t.Errorf("%v: fits() = %v, want %v", tt.name, got, tt.fits)
+		}
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	c := NewCoordinator(memory.New())
+	client := dial(t, serve(t, c))
+	for _, w := range []WorkerInfo{
+		{ID: "small", CPU: 1, Memory: 512},
+		{ID: "large", CPU: 8, Memory: 4096, Labels: map[string]string{"disk": "ssd"}},
+	} {
+		if err := client.Call(serviceName+".Register", &RegisterArgs{Worker: w}, &RegisterReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tests := []struct {
+		spec   component.TaskSpec
+		worker string
+		reason string
+	}{
+		{component.TaskSpec{Name: "ssd", Labels: map[string]string{"disk": "ssd"}, Resources: component.Resources{CPU: 1, Slots: 1}}, "large", ""},
+		{component.TaskSpec{Name: "big", Resources: component.Resources{CPU: 8, Memory: 4096}}, "", ReasonInsufficientResources},
+		{component.TaskSpec{Name: "huge", Resources: component.Resources{Memory: 8192}}, "", ReasonNoEligibleWorker},
+		{component.TaskSpec{Name: "gpu", Labels: map[string]string{"gpu": "yes"}}, "", ReasonNoEligibleWorker},
+	}
+	tasks := make([]*remoteTask, len(tests))
+	for i, tt := range tests {
+		tasks[i] = c.Task(tt.spec).(*remoteTask)
+		execute(ctx, tasks[i])
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Small worker has no label and capacity for any of the tasks
+	if reply := poll(t, client, "small"); len(reply.Assignments) != 0 {
+		t.Errorf("Poll(small) assigned %+v", reply.Assignments)
+	}
+	reply := poll(t, client, "large")
+	if len(reply.Assignments) != 1 || reply.Assignments[0].Spec.Name != "ssd" {
+		t.Fatalf("Poll(large) assigned %+v, want ssd", reply.Assignments)
+	}
+	for i, tt := range tests {
+		if w, r := tasks[i].Worker(), tasks[i].Reason(); w != tt.worker || r != tt.reason {
+			t.Errorf("%v: placed on %q with reason %q, want %q with %q", tt.spec.Name, w, r, tt.worker, tt.reason)
+		}
+	}
+}
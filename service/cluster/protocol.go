@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"errors"
+	"time"
+
+	"github.com/caelifer/runner/component"
+)
+
+// serviceName is a name coordinator is registered under in RPC server.
+const serviceName = "Coordinator"
+
+// Exported errors.
+var (
+	// ErrUnknownWorker error is returned to workers which are not (or no longer) registered with coordinator.
+	ErrUnknownWorker = errors.New("unknown worker")
+)
+
+// WorkerInfo describes worker node and its capabilities.
+type WorkerInfo struct {
+	ID     string
+	Labels map[string]string
+	// CPU is number of CPUs.
+	CPU int
+	// Memory is available memory in MiB.
+	Memory int64
+	// Slots is number of tasks worker runs concurrently, defaults to CPU.
+	Slots int
+}
+
+// RegisterArgs are arguments of Coordinator.Register call.
+type RegisterArgs struct {
+	Worker WorkerInfo
+	// Running are ids of tasks worker still runs or has not reported yet, e.g. after reconnecting;
+	// other tasks coordinator assigned to the worker are reassigned.
+	Running []string
+}
+
+// RegisterReply is a reply to Coordinator.Register call.
+type RegisterReply struct{}
+
+// PollArgs are arguments of Coordinator.Poll call. Poll blocks up to Wait for new work.
+type PollArgs struct {
+	WorkerID string
+	Wait     time.Duration
+}
+
+// PollReply is a reply to Coordinator.Poll call.
+type PollReply struct {
+	Assignments []Assignment
+	// Cancelled lists ids of previously assigned tasks worker should abandon.
+	Cancelled []string
+}
+
+// Assignment is a task assigned to worker.
+type Assignment struct {
+	TaskID string
+	Spec   component.TaskSpec
+	// Traceparent is W3C trace context of the job's task span, worker continues the trace.
+	Traceparent string
+}
+
+// ReportArgs are arguments of Coordinator.Report call, worker sends it when assigned task finishes.
+type ReportArgs struct {
+	WorkerID string
+	TaskID   string
+	Error    string
+	// ExitCode is exit code of task's command, -1 if command did not exit on its own.
+	ExitCode int
+	Duration time.Duration
+}
+
+// ReportReply is a reply to Coordinator.Report call.
+type ReportReply struct{}
+
+// QueueArgs are arguments of Coordinator.Queue call.
+type QueueArgs struct{}
+
+// QueueReply is a reply to Coordinator.Queue call.
+type QueueReply struct {
+	Entries []QueueEntry
+}
+
+// QueueEntry describes task waiting for a worker.
+type QueueEntry struct {
+	TaskID   string
+	Name     string
+	Tenant   string
+	Priority int
+	// Position is 1-based place in dispatch order.
+	Position int
+	// Reason explains why task is not running yet.
+	Reason string
+}
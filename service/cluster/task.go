@@ -0,0 +1,167 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/store"
+)
+
+// remoteTask is a component.Task executed by one of coordinator's workers.
+type remoteTask struct {
+	id        string
+	spec      component.TaskSpec
+	c         *Coordinator
+	lifecycle *component.Lifecycle
+
+	mu       sync.Mutex
+	jobID    string
+	worker   string
+	reason   string
+	exitCode int
+	err      error
+}
+
+// Execute submits task to coordinator and waits for worker to report its outcome.
+func (t *remoteTask) Execute(ctx context.Context) (err error) {
+	// Failed task may be executed again
+	if s := t.lifecycle.Status(); s == component.StatusFailed || s == component.StatusTimedOut {
+		if err = t.lifecycle.To(component.StatusRetrying); err != nil {
+			return
+		}
+	}
+	if err = t.lifecycle.To(component.StatusQueued); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	if id, ok := component.JobIDFromContext(ctx); ok {
+		t.jobID = id
+	}
+	t.exitCode = -1
+	t.err = nil
+	t.mu.Unlock()
+
+	res := t.c.submit(ctx, t)
+	select {
+	case err = <-res:
+	case <-ctx.Done():
+		t.c.cancel(t.id)
+		err = ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = errors.New("execution timed out")
+		}
+	}
+
+	t.mu.Lock()
+	t.err = err
+	t.mu.Unlock()
+	_ = t.lifecycle.To(component.Outcome(ctx, err))
+
+	return
+}
+
+func (t *remoteTask) Name() string {
+	return t.spec.Name
+}
+
+func (t *remoteTask) ID() string {
+	return t.id
+}
+
+// Success reports whether task was executed successfully.
+func (t *remoteTask) Success() bool {
+	return t.lifecycle.Status() == component.StatusSucceeded
+}
+
+// Status returns task's lifecycle status.
+func (t *remoteTask) Status() component.Status {
+	return t.lifecycle.Status()
+}
+
+// Skip marks task which is not going to be executed.
+func (t *remoteTask) Skip() error {
+	return t.lifecycle.To(component.StatusSkipped)
+}
+
+// Worker returns id of the worker task was assigned to.
+func (t *remoteTask) Worker() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.worker
+}
+
+// Reason explains why task is still pending, it is empty once task is assigned.
+func (t *remoteTask) Reason() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reason
+}
+
+func (t *remoteTask) String() string {
+	return fmt.Sprintf("%v: %q", t.spec.Name,
+		strings.Join(append([]string{t.spec.Cmd}, t.spec.Args...), " "))
+}
+
+// Record returns snapshot of task's state to be persisted.
+func (t *remoteTask) Record() *store.TaskRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rec := &store.TaskRecord{
+		TaskID:   t.id,
+		JobID:    t.jobID,
+		Name:     t.spec.Name,
+		Spec:     t.spec,
+		Worker:   t.worker,
+		ExitCode: t.exitCode,
+		Meta: store.Meta{
+			Status:     t.lifecycle.Status(),
+			History:    t.lifecycle.History(),
+			CreatedAt:  t.lifecycle.Created(),
+			StartedAt:  t.lifecycle.Started(),
+			FinishedAt: t.lifecycle.Finished(),
+			Attempts:   t.lifecycle.Attempts(),
+			SpecHash:   t.spec.Hash(),
+		},
+	}
+	if t.err != nil {
+		rec.Error = t.err.Error()
+	}
+	return rec
+}
+
+// setWorker records worker task is assigned to, empty id puts task back to the queue.
+func (t *remoteTask) setWorker(id string) {
+	t.mu.Lock()
+	t.worker = id
+	t.mu.Unlock()
+
+	if id != "" {
+		_ = t.lifecycle.To(component.StatusRunning)
+		return
+	}
+	if t.lifecycle.To(component.StatusRetrying) == nil {
+		_ = t.lifecycle.To(component.StatusQueued)
+	}
+}
+
+// setExitCode records exit code reported by worker.
+func (t *remoteTask) setExitCode(code int) {
+	t.mu.Lock()
+	t.exitCode = code
+	t.mu.Unlock()
+}
+
+// setReason updates pending reason and reports whether it changed.
+func (t *remoteTask) setReason(reason string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := t.reason != reason
+	t.reason = reason
+	return changed
+}
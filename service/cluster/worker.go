@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"context"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/component/task"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/tracing"
+)
+
+// retryInterval is a pause between attempts to reach coordinator.
+const retryInterval = 2 * time.Second
+
+// Worker executes tasks assigned by coordinator.
+type Worker struct {
+	info   WorkerInfo
+	addr   string
+	logger logging.Logger
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+	wg      sync.WaitGroup
+	// client is connection of the current session, connected is closed and replaced when session starts
+	client    *rpc.Client
+	connected chan struct{}
+}
+
+// WorkerOption configures Worker.
+type WorkerOption func(*Worker)
+
+// WithWorkerLogger sets worker's logger, it is also passed to executed tasks.
+func WithWorkerLogger(l logging.Logger) WorkerOption {
+	return func(w *Worker) {
+		w.logger = l
+	}
+}
+
+// NewWorker creates new worker node which connects to coordinator at provided address.
+func NewWorker(info WorkerInfo, addr string, opts ...WorkerOption) *Worker {
+	if info.CPU < 1 {
+		info.CPU = 1
+	}
+	w := &Worker{
+		info:      info,
+		addr:      addr,
+		logger:    logging.Default(),
+		running:   make(map[string]context.CancelFunc),
+		connected: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Run executes assigned tasks until context is cancelled. Lost coordinator connection is re-established.
+func (w *Worker) Run(ctx context.Context) error {
+	defer w.wg.Wait()
+
+	for {
+		err := w.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		w.log("disconnected", "", "", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// session registers with coordinator and serves assignments until connection fails.
+func (w *Worker) session(ctx context.Context) error {
+	client, err := rpc.Dial("tcp", w.addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Tasks started in previous sessions are kept, their outcomes are reported through this one
+	w.mu.Lock()
+	args := &RegisterArgs{Worker: w.info}
+	for id := range w.running {
+		args.Running = append(args.Running, id)
+	}
+	w.mu.Unlock()
+	if err := w.call(ctx, client, "Register", args, &RegisterReply{}); err != nil {
+		return err
+	}
+	w.log("registered", "", "", nil)
+
+	w.mu.Lock()
+	w.client = client
+	close(w.connected)
+	w.connected = make(chan struct{})
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.client = nil
+		w.mu.Unlock()
+	}()
+
+	for {
+		var reply PollReply
+		err := w.call(ctx, client, "Poll", &PollArgs{WorkerID: w.info.ID, Wait: maxPollWait}, &reply)
+		if err != nil {
+			return err
+		}
+
+		w.mu.Lock()
+		for _, id := range reply.Cancelled {
+			if cancel, ok := w.running[id]; ok {
+				cancel()
+			}
+		}
+		w.mu.Unlock()
+
+		for _, a := range reply.Assignments {
+			w.execute(ctx, a)
+		}
+	}
+}
+
+// execute runs assigned task in background and reports its outcome.
+func (w *Worker) execute(ctx context.Context, a Assignment) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	w.mu.Lock()
+	w.running[a.TaskID] = cancel
+	w.mu.Unlock()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() {
+			w.mu.Lock()
+			delete(w.running, a.TaskID)
+			w.mu.Unlock()
+			cancel()
+		}()
+
+		// Continue trace of the job which submitted the task
+		if sc, err := tracing.ParseTraceparent(a.Traceparent); err == nil {
+			ctx = tracing.WithRemoteParent(ctx, sc)
+		}
+		ctx, span := tracing.Start(ctx, "worker.execute",
+			"worker.id", w.info.ID,
+			"task.id", a.TaskID,
+			"task.name", a.Spec.Name,
+		)
+
+		w.log("task-started", a.TaskID, a.Spec.Name, nil)
+		t0 := time.Now()
+		t := task.New(a.Spec, task.WithLogger(w.logger))
+		err := t.Execute(ctx)
+		span.End(err)
+		if ctx.Err() != nil {
+			// Task was withdrawn or worker is shutting down, coordinator takes care of it
+			w.log("task-abandoned", a.TaskID, a.Spec.Name, ctx.Err())
+			return
+		}
+
+		args := &ReportArgs{
+			WorkerID: w.info.ID,
+			TaskID:   a.TaskID,
+			ExitCode: t.Record().ExitCode,
+			Duration: time.Since(t0),
+		}
+		if err != nil {
+			args.Error = err.Error()
+		}
+		if rerr := w.report(ctx, args); rerr != nil {
+			// Worker is shutting down, coordinator reassigns the task once it considers this worker gone
+			w.log("report-failed", a.TaskID, a.Spec.Name, rerr)
+			return
+		}
+		w.log("task-finished", a.TaskID, a.Spec.Name, err)
+	}()
+}
+
+// report delivers task's outcome through the current session, failed attempts are repeated once worker
+// reconnects. It gives up only when context is cancelled.
+func (w *Worker) report(ctx context.Context, args *ReportArgs) error {
+	for {
+		w.mu.Lock()
+		client, connected := w.client, w.connected
+		w.mu.Unlock()
+
+		if client != nil {
+			err := w.call(ctx, client, "Report", args, &ReportReply{})
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			w.log("report-retrying", args.TaskID, "", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-connected:
+		}
+	}
+}
+
+// call invokes coordinator's method, giving up when context is cancelled.
+func (w *Worker) call(ctx context.Context, client *rpc.Client, method string, args, reply interface{}) error {
+	c := client.Go(serviceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.Done:
+		if c.Error != nil && c.Error.Error() == ErrUnknownWorker.Error() {
+			return ErrUnknownWorker
+		}
+		return c.Error
+	}
+}
+
+func (w *Worker) log(event, taskID, name string, err error) {
+	args := []interface{}{"component", "cluster-worker", "worker", w.info.ID, "event", event}
+	if taskID != "" {
+		args = append(args, "task_id", taskID, "name", name)
+	}
+	logging.Outcome(w.logger, err, "worker "+event, args...)
+}
@@ -0,0 +1,172 @@
+package fairshare
+
+import (
+	"context"
+	"sort"
+)
+
+// DefaultTenant is a tenant of work submitted without one.
+const DefaultTenant = "default"
+
+// Class identifies who owns queued work and how urgent it is.
+type Class struct {
+	Tenant string
+	// Priority orders work within a tenant, higher values go first.
+	Priority int
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of parent context carrying scheduling class.
+func NewContext(ctx context.Context, c Class) context.Context {
+	return context.WithValue(ctx, ctxKey{}, c)
+}
+
+// FromContext returns scheduling class stored in context, or default class.
+func FromContext(ctx context.Context) Class {
+	c, _ := ctx.Value(ctxKey{}).(Class)
+	if c.Tenant == "" {
+		c.Tenant = DefaultTenant
+	}
+	return c
+}
+
+// Entry is a unit of work waiting in the queue.
+type Entry struct {
+	ID    string
+	Class Class
+	Value interface{}
+	seq   uint64
+}
+
+// Queue orders work with weighted fair share across tenants and strict priority within a tenant.
+// Tenant with the lowest number of running entries relative to its weight goes next; ties are broken
+// by the number of entries ever started relative to weight. Queue is not safe for concurrent use.
+type Queue struct {
+	weights map[string]int
+	seq     uint64
+	entries []*Entry
+	running map[string]int
+	started map[string]int
+}
+
+// New creates new queue with provided tenant weights, tenants not listed have weight 1.
+func New(weights map[string]int) *Queue {
+	return &Queue{
+		weights: weights,
+		running: make(map[string]int),
+		started: make(map[string]int),
+	}
+}
+
+// Push adds entry to the queue. Entry returned to the queue with Requeue keeps its original place.
+func (q *Queue) Push(e *Entry) {
+	if e.Class.Tenant == "" {
+		e.Class.Tenant = DefaultTenant
+	}
+	q.seq++
+	e.seq = q.seq
+	q.entries = append(q.entries, e)
+}
+
+// Requeue returns previously started entry back to the queue, e.g. when its executor is lost.
+func (q *Queue) Requeue(e *Entry) {
+	q.Finish(e)
+	q.started[e.Class.Tenant]--
+	q.entries = append(q.entries, e)
+}
+
+// Remove withdraws entry which has not been started yet and reports whether it was found.
+func (q *Queue) Remove(id string) bool {
+	for i, e := range q.entries {
+		if e.ID == id {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Start removes entry from the queue and accounts it as running for its tenant.
+func (q *Queue) Start(e *Entry) {
+	if q.Remove(e.ID) {
+		q.running[e.Class.Tenant]++
+		q.started[e.Class.Tenant]++
+	}
+}
+
+// Finish accounts the end of started entry.
+func (q *Queue) Finish(e *Entry) {
+	if q.running[e.Class.Tenant] > 0 {
+		q.running[e.Class.Tenant]--
+	}
+}
+
+// Len returns number of waiting entries.
+func (q *Queue) Len() int {
+	return len(q.entries)
+}
+
+// Order returns waiting entries in dispatch order, assuming every one of them starts in turn.
+func (q *Queue) Order() []*Entry {
+	// Per-tenant queues ordered by priority, then by arrival
+	byTenant := make(map[string][]*Entry)
+	for _, e := range q.entries {
+		byTenant[e.Class.Tenant] = append(byTenant[e.Class.Tenant], e)
+	}
+	tenants := make([]string, 0, len(byTenant))
+	for t, es := range byTenant {
+		sort.Slice(es, func(i, k int) bool {
+			if es[i].Class.Priority != es[k].Class.Priority {
+				return es[i].Class.Priority > es[k].Class.Priority
+			}
+			return es[i].seq < es[k].seq
+		})
+		tenants = append(tenants, t)
+	}
+	sort.Strings(tenants)
+
+	running := make(map[string]int, len(q.running))
+	started := make(map[string]int, len(q.started))
+	for t, n := range q.running {
+		running[t] = n
+	}
+	for t, n := range q.started {
+		started[t] = n
+	}
+
+	order := make([]*Entry, 0, len(q.entries))
+	for len(order) < len(q.entries) {
+		next := ""
+		for _, t := range tenants {
+			if len(byTenant[t]) == 0 {
+				continue
+			}
+			if next == "" || q.less(t, next, running, started) {
+				next = t
+			}
+		}
+		order = append(order, byTenant[next][0])
+		byTenant[next] = byTenant[next][1:]
+		running[next]++
+		started[next]++
+	}
+	return order
+}
+
+// less reports whether tenant a is further below its fair share than tenant b.
+func (q *Queue) less(a, b string, running, started map[string]int) bool {
+	wa, wb := q.weight(a), q.weight(b)
+	// Compare running[a]/wa < running[b]/wb without division
+	if ra, rb := running[a]*wb, running[b]*wa; ra != rb {
+		return ra < rb
+	}
+	return started[a]*wb < started[b]*wa
+}
+
+func (q *Queue) weight(tenant string) int {
+	if w, ok := q.weights[tenant]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
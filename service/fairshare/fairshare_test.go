@@ -0,0 +1,128 @@
+package fairshare
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func entry(id, tenant string, priority int) *Entry {
+	return &Entry{ID: id, Class: Class{Tenant: tenant, Priority: priority}}
+}
+
+func ids(es []*Entry) []string {
+	res := make([]string, 0, len(es))
+	for _, e := range es {
+		res = append(res, e.ID)
+	}
+	return res
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		// running entries are started before waiting ones are pushed
+		running []*Entry
+		waiting []*Entry
+		want    []string
+	}{
+		{
+			name:    "priority then arrival within tenant",
+			waiting: []*Entry{entry("a1", "a", 0), entry("a2", "a", 5), entry("a3", "a", 0), entry("a4", "a", 5)},
+			want:    []string{"a2", "a4", "a1", "a3"},
+		},
+		{
+			name:    "equal weights alternate",
+			waiting: []*Entry{entry("a1", "a", 0), entry("a2", "a", 0), entry("a3", "a", 0), entry("b1", "b", 0)},
+			want:    []string{"a1", "b1", "a2", "a3"},
+		},
+		{
+			name:    "weights",
+			weights: map[string]int{"a": 2},
+			waiting: []*Entry{
+				entry("a1", "a", 0), entry("a2", "a", 0), entry("a3", "a", 0), entry("a4", "a", 0),
+				entry("b1", "b", 0), entry("b2", "b", 9),
+			},
+			want: []string{"a1", "b2", "a2", "a3", "b1", "a4"},
+		},
+		{
+			name:    "running entries count against tenant",
+			running: []*Entry{entry("a0", "a", 0), entry("a00", "a", 0)},
+			waiting: []*Entry{entry("a1", "a", 9), entry("b1", "b", 0), entry("b2", "b", 0)},
+			want:    []string{"b1", "b2", "a1"},
+		},
+		{
+			name:    "non-positive weight counts as one",
+			weights: map[string]int{"a": 0, "b": -3},
+			waiting: []*Entry{entry("a1", "a", 0), entry("a2", "a", 0), entry("b1", "b", 0), entry("b2", "b", 0)},
+			want:    []string{"a1", "b1", "a2", "b2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New(tt.weights)
+			for _, e := range tt.running {
+				q.Push(e)
+				q.Start(e)
+			}
+			for _, e := range tt.waiting {
+				q.Push(e)
+			}
+			if got := ids(q.Order()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Order() = %v, want %v", got, tt.want)
+			}
+			if q.Len() != len(tt.waiting) {
+				t.Errorf("Len() = %d, want %d", q.Len(), len(tt.waiting))
+			}
+		})
+	}
+}
+
+func TestQueueLifecycle(t *testing.T) {
+	q := New(nil)
+	a1, a2, b1 := entry("a1", "a", 0), entry("a2", "a", 0), entry("b1", "", 0)
+	for _, e := range []*Entry{a1, a2, b1} {
+		q.Push(e)
+	}
+	if b1.Class.Tenant != DefaultTenant {
+		t.Errorf("entry without tenant has tenant %q, want %q", b1.Class.Tenant, DefaultTenant)
+	}
+
+	// Requeued entry keeps its original place
+	q.Start(a1)
+	if got, want := ids(q.Order()), []string{"b1", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() after start = %v, want %v", got, want)
+	}
+	q.Requeue(a1)
+	if got, want := ids(q.Order()), []string{"a1", "b1", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() after requeue = %v, want %v", got, want)
+	}
+
+	// Finished entries no longer run, tie is broken by number of entries tenants started
+	q.Start(a1)
+	q.Start(a2)
+	q.Finish(a1)
+	q.Finish(a2)
+	q.Push(entry("a3", "a", 0))
+	if got, want := ids(q.Order()), []string{"b1", "a3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() after finish = %v, want %v", got, want)
+	}
+
+	if !q.Remove("b1") || q.Remove("b1") {
+		t.Error("Remove(b1) did not remove entry exactly once")
+	}
+	if q.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", q.Len())
+	}
+}
+
+func TestContext(t *testing.T) {
+	if c := FromContext(context.Background()); c != (Class{Tenant: DefaultTenant}) {
+		t.Errorf("FromContext() without class = %+v", c)
+	}
+	want := Class{Tenant: "media", Priority: 3}
+	if c := FromContext(NewContext(context.Background(), want)); c != want {
+		t.Errorf("FromContext() = %+v, want %+v", c, want)
+	}
+}
@@ -2,15 +2,21 @@ package generator
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/oklog/ulid"
 )
 
 var (
-	entropy = rand.New(rand.NewSource(time.Now().UnixNano()))
+	// IDs generated within the same millisecond are monotonically increasing, so that ordering by id
+	// preserves creation order
+	mu      sync.Mutex
+	entropy = ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0)
 )
 
 func NewID() string {
+	mu.Lock()
+	defer mu.Unlock()
 	return ulid.MustNew(ulid.Timestamp(time.Now()), entropy).String()
 }
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Logger is a leveled structured logger. Arguments following the message are alternating keys and values,
+// the same way log/slog treats them.
+//
+// Components use consistent keys: "component", "job_id", "task_id", "duration_ms" and "error".
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+	// With returns a logger which adds provided key-value pairs to every entry.
+	With(args ...interface{}) Logger
+}
+
+// slogLogger adapts slog.Logger to Logger interface.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlog adapts provided slog.Logger.
+func NewSlog(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+// New creates logger writing JSON lines of provided and higher levels to w.
+func New(w io.Writer, level slog.Level) Logger {
+	return NewSlog(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+// Default returns logger writing JSON lines of info and higher levels to standard error.
+func Default() Logger {
+	return New(os.Stderr, slog.LevelInfo)
+}
+
+// Discard returns logger which drops all entries, it is handy in tests.
+func Discard() Logger {
+	return New(io.Discard, slog.LevelError+1)
+}
+
+func (s slogLogger) Debug(msg string, args ...interface{}) {
+	s.l.Debug(msg, args...)
+}
+
+func (s slogLogger) Info(msg string, args ...interface{}) {
+	s.l.Info(msg, args...)
+}
+
+func (s slogLogger) Warn(msg string, args ...interface{}) {
+	s.l.Warn(msg, args...)
+}
+
+func (s slogLogger) Error(msg string, args ...interface{}) {
+	s.l.Error(msg, args...)
+}
+
+func (s slogLogger) With(args ...interface{}) Logger {
+	return slogLogger{s.l.With(args...)}
+}
+
+// DurationMs converts duration to fractional milliseconds, the unit of "duration_ms" field.
+func DurationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Outcome logs operation's outcome: successful one at info level, failed one at error level with "error" field.
+func Outcome(l Logger, err error, msg string, args ...interface{}) {
+	if err != nil {
+		l.Error(msg, append(args, "error", err.Error())...)
+		return
+	}
+	l.Info(msg, args...)
+}
+
+// ParseLevel parses level name: debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
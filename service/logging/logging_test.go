@@ -0,0 +1,118 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// entries decodes JSON lines written by logger.
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("malformed entry %q: %v", line, err)
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+func TestLevel(t *testing.T) {
+	tests := []struct {
+		level slog.Level
+		want  []string
+	}{
+		{slog.LevelDebug, []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+		{slog.LevelInfo, []string{"INFO", "WARN", "ERROR"}},
+		{slog.LevelError, []string{"ERROR"}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		l := New(&buf, tt.level)
+		l.Debug("m")
+		l.Info("m")
+		l.Warn("m")
+		l.Error("m")
+
+		es := entries(t, &buf)
+		if len(es) != len(tt.want) {
+			t.Fatalf("level %v: logged %d entries, want %d", tt.level, len(es), len(tt.want))
+		}
+		for i, e := range es {
+			if e["level"] != tt.want[i] {
+				t.Errorf("level %v: entry %d has level %v, want %v", tt.level, i, e["level"], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, slog.LevelInfo).With("component", "job", "job_id", "j1")
+	l.Info("job-started", "duration_ms", DurationMs(1500*time.Microsecond))
+
+	es := entries(t, &buf)
+	if len(es) != 1 {
+		t.Fatalf("logged %d entries, want 1", len(es))
+	}
+	e := es[0]
+	if e["msg"] != "job-started" || e["component"] != "job" || e["job_id"] != "j1" || e["duration_ms"] != 1.5 {
+		t.Errorf("entry = %v", e)
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		err   error
+		level string
+	}{
+		{nil, "INFO"},
+		{errors.New("boom"), "ERROR"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		Outcome(New(&buf, slog.LevelInfo), tt.err, "task-finished", "task_id", "t1")
+
+		es := entries(t, &buf)
+		if len(es) != 1 {
+			t.Fatalf("Outcome(%v) logged %d entries, want 1", tt.err, len(es))
+		}
+		e := es[0]
+		if e["level"] != tt.level || e["task_id"] != "t1" {
+			t.Errorf("Outcome(%v) logged %v, want level %v", tt.err, e, tt.level)
+		}
+		if errStr, ok := e["error"]; tt.err != nil && errStr != tt.err.Error() || tt.err == nil && ok {
+			t.Errorf("Outcome(%v) logged error %v", tt.err, errStr)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want slog.Level
+		err  bool
+	}{
+		{"debug", slog.LevelDebug, false},
+		{"INFO", slog.LevelInfo, false},
+		{"warn", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"verbose", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.in)
+		if (err != nil) != tt.err || err == nil && got != tt.want {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
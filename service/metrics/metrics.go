@@ -0,0 +1,328 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Default is the registry metrics created by package level constructors are registered in.
+var Default = NewRegistry()
+
+// collector is a metric family which can be exposed in the Prometheus text format.
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry is a set of metric families.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates empty registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// register adds collector to the registry, registering the same name twice is a programming error.
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.collectors[c.name()]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", c.name()))
+	}
+	r.collectors[c.name()] = c
+}
+
+// Write writes all metrics in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for n := range r.collectors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, 0, len(names))
+	for _, n := range names {
+		collectors = append(collectors, r.collectors[n])
+	}
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// ServeHTTP exposes registry's metrics, it implements http.Handler interface.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Handler returns http.Handler exposing metrics of the default registry.
+func Handler() http.Handler {
+	return Default
+}
+
+// family holds metric family's description and its labeled series.
+type family struct {
+	fname  string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is a single labeled time series.
+type series struct {
+	values []string
+
+	mu      sync.Mutex
+	value   float64   // counter and gauge value
+	buckets []float64 // histogram upper bounds
+	counts  []uint64  // histogram cumulative counts, one per bucket
+	count   uint64
+	sum     float64
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{
+		fname:  name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+func (f *family) name() string {
+	return f.fname
+}
+
+// with returns series for provided label values, creating it on first use.
+func (f *family) with(values []string, buckets []float64) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %v expects %d label values, got %d", f.fname, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if buckets != nil {
+			s.buckets = buckets
+			s.counts = make([]uint64, len(buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		series = append(series, f.series[k])
+	}
+	f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.fname, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.fname, f.kind)
+	for _, s := range series {
+		s.mu.Lock()
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.fname, f.labelPairs(s.values, "", 0), formatFloat(s.value))
+			s.mu.Unlock()
+			continue
+		}
+		for i, b := range s.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.fname, f.labelPairs(s.values, "le", b), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.fname, f.labelPairs(s.values, "le", math.Inf(1)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.fname, f.labelPairs(s.values, "", 0), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.fname, f.labelPairs(s.values, "", 0), s.count)
+		s.mu.Unlock()
+	}
+}
+
+// labelPairs formats label set, optionally extended with histogram's "le" label.
+func (f *family) labelPairs(values []string, le string, bound float64) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, f.labels[i], escapeLabel(v)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, le, formatFloat(bound)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a family of monotonically increasing counters partitioned by labels.
+type CounterVec struct {
+	f *family
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	s *series
+}
+
+// NewCounter creates counter family in the default registry.
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newFamily(name, help, "counter", labels)}
+	Default.register(c.f)
+	if len(labels) == 0 {
+		// Unlabeled metric is exposed right away
+		c.With()
+	}
+	return c
+}
+
+// With returns counter for provided label values.
+func (c *CounterVec) With(values ...string) Counter {
+	return Counter{c.f.with(values, nil)}
+}
+
+// Inc increments counter by one.
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments counter by non-negative value.
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.s.mu.Lock()
+	c.s.value += v
+	c.s.mu.Unlock()
+}
+
+// GaugeVec is a family of arbitrary values partitioned by labels.
+type GaugeVec struct {
+	f *family
+}
+
+// Gauge is a value which can go up and down.
+type Gauge struct {
+	s *series
+}
+
+// NewGauge creates gauge family in the default registry.
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newFamily(name, help, "gauge", labels)}
+	Default.register(g.f)
+	if len(labels) == 0 {
+		g.With()
+	}
+	return g
+}
+
+// With returns gauge for provided label values.
+func (g *GaugeVec) With(values ...string) Gauge {
+	return Gauge{g.f.with(values, nil)}
+}
+
+// Set sets gauge's value.
+func (g Gauge) Set(v float64) {
+	g.s.mu.Lock()
+	g.s.value = v
+	g.s.mu.Unlock()
+}
+
+// Add adds value, possibly negative, to the gauge.
+func (g Gauge) Add(v float64) {
+	g.s.mu.Lock()
+	g.s.value += v
+	g.s.mu.Unlock()
+}
+
+// HistogramVec is a family of histograms partitioned by labels.
+type HistogramVec struct {
+	f       *family
+	buckets []float64
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	s *series
+}
+
+// NewHistogram creates histogram family in the default registry. Nil buckets mean DefBuckets.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &HistogramVec{newFamily(name, help, "histogram", labels), buckets}
+	Default.register(h.f)
+	if len(labels) == 0 {
+		h.With()
+	}
+	return h
+}
+
+// With returns histogram for provided label values.
+func (h *HistogramVec) With(values ...string) Histogram {
+	return Histogram{h.f.with(values, h.buckets)}
+}
+
+// Observe adds single observation.
+func (h Histogram) Observe(v float64) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	for i, b := range h.s.buckets {
+		if v <= b {
+			h.s.counts[i]++
+		}
+	}
+	h.s.count++
+	h.s.sum += v
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// isolate makes package level constructors register metrics in a fresh registry.
+func isolate(t *testing.T) *Registry {
+	t.Helper()
+	prev := Default
+	Default = NewRegistry()
+	t.Cleanup(func() { Default = prev })
+	return Default
+}
+
+func TestExposition(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func()
+		want   string
+	}{
+		{
+			name: "unlabeled counter is exposed before first use",
+			record: func() {
+				NewCounter("jobs_total", "Number of jobs.")
+			},
+			want: "# HELP jobs_total Number of jobs.\n# TYPE jobs_total counter\njobs_total 0\n",
+		},
+		{
+			name: "labeled counter ignores negative increments",
+			record: func() {
+				c := NewCounter("tasks_total", "Number of tasks.", "status")
+				c.With("ok").Inc()
+				c.With("ok").Add(2)
+				c.With("failed").Add(-1)
+			},
+			want: "# HELP tasks_total Number of tasks.\n# TYPE tasks_total counter\n" +
+				"tasks_total{status=\"failed\"} 0\ntasks_total{status=\"ok\"} 3\n",
+		},
+		{
+			name: "gauge",
+			record: func() {
+				g := NewGauge("depth", "Queue depth.")
+				g.With().Set(5)
+				g.With().Add(-2)
+			},
+			want: "# HELP depth Queue depth.\n# TYPE depth gauge\ndepth 3\n",
+		},
+		{
+			name: "histogram buckets are cumulative",
+			record: func() {
+				h := NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1}, "op")
+				h.With("get").Observe(0.05)
+				h.With("get").Observe(0.5)
+				h.With("get").Observe(2)
+			},
+			want: "# HELP latency_seconds Latency.\n# TYPE latency_seconds histogram\n" +
+				"latency_seconds_bucket{op=\"get\",le=\"0.1\"} 1\n" +
+				"latency_seconds_bucket{op=\"get\",le=\"1\"} 2\n" +
+				"latency_seconds_bucket{op=\"get\",le=\"+Inf\"} 3\n" +
+				"latency_seconds_sum{op=\"get\"} 2.55\n" +
+				"latency_seconds_count{op=\"get\"} 3\n",
+		},
+		{
+			name: "escaping",
+			record: func() {
+				NewCounter("errors_total", "Errors\nby \\ kind.", "kind").With("a\"b\\c\nd").Inc()
+			},
+			want: "# HELP errors_total Errors\\nby \\\\ kind.\n# TYPE errors_total counter\n" +
+				"errors_total{kind=\"a\\\"b\\\\c\\nd\"} 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := isolate(t)
+			tt.record()
+
+			var buf bytes.Buffer
+			r.Write(&buf)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("Write() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := isolate(t)
+	NewGauge("b", "B.")
+	NewCounter("a", "A.")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	if a, b := strings.Index(body, "# HELP a "), strings.Index(body, "# HELP b "); a < 0 || b < 0 || a > b {
+		t.Errorf("metrics are not sorted by name:\n%s", body)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering duplicate metric did not panic")
+		}
+	}()
+	NewCounter("a", "A.")
+}
+
+func TestLabelValues(t *testing.T) {
+	isolate(t)
+	c := NewCounter("c_total", "C.", "x", "y")
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong number of label values did not panic")
+		}
+	}()
+	c.With("only-x")
+}
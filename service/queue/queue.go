@@ -0,0 +1,474 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/fairshare"
+	"github.com/caelifer/runner/service/generator"
+	"github.com/caelifer/runner/service/metrics"
+	"github.com/caelifer/runner/service/store"
+)
+
+// State is a delivery state of queued item.
+type State string
+
+// Item states.
+const (
+	StatePending   State = "pending"
+	StateLeased    State = "leased"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+)
+
+// Exported errors.
+var (
+	// ErrEmpty error is returned when there is nothing to lease.
+	ErrEmpty = errors.New("queue is empty")
+	// ErrLeaseLost error is returned when lease expired and item was handed over to another worker.
+	ErrLeaseLost = errors.New("lease lost")
+)
+
+var (
+	queueDepth = metrics.NewGauge("runner_queue_depth", "Number of queued jobs waiting for a worker.")
+	retries    = metrics.NewCounter("runner_queue_retries_total", "Number of queued jobs redelivered after their lease expired or worker restarted.")
+)
+
+// DefaultLeaseTTL is how long worker owns leased item without heartbeat.
+const DefaultLeaseTTL = 30 * time.Second
+
+// minLeaseTTL is the shortest lease duration, workers send heartbeats several times per lease.
+const minLeaseTTL = time.Millisecond
+
+// Item is a job submitted to the queue, it is persisted in the data store.
+type Item struct {
+	ItemID      string            `json:"id"`
+	Spec        component.JobSpec `json:"spec"`
+	State       State             `json:"state"`
+	Owner       string            `json:"owner,omitempty"`
+	LeaseUntil  time.Time         `json:"lease_until,omitempty"`
+	Attempts    int               `json:"attempts"`
+	Completed   []string          `json:"completed,omitempty"` // names of tasks finished in previous attempts
+	JobID       string            `json:"job_id,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	SubmittedAt time.Time         `json:"submitted_at"`
+	store.Version
+}
+
+// ID returns item's id, it implements store.Record interface.
+func (i *Item) ID() string {
+	return i.ItemID
+}
+
+// Success reports whether queued job succeeded, it implements store.Record interface.
+func (i *Item) Success() bool {
+	return i.State == StateSucceeded
+}
+
+// itemKind is kind items are registered under in data store.
+const itemKind = "queue-item"
+
+func init() {
+	store.RegisterKind(itemKind, &Item{})
+}
+
+// Summary describes item's queryable state, it implements store.Summarizer interface. Item's status is its
+// delivery state and worker leasing it is its owner.
+func (i *Item) Summary() store.Summary {
+	return store.Summary{
+		Name:    i.Spec.Name,
+		Status:  component.Status(i.State),
+		Created: i.SubmittedAt,
+		Owner:   i.Owner,
+		Expires: i.LeaseUntil,
+	}
+}
+
+// waiting reports whether item is waiting to be leased, leases expired by the time are taken over.
+func (i *Item) waiting(now time.Time) bool {
+	return i.State == StatePending || i.State == StateLeased && now.After(i.LeaseUntil)
+}
+
+// clone makes a deep copy of item, so that records kept by data store are never shared.
+func (i *Item) clone() *Item {
+	c := *i
+	c.Completed = append([]string(nil), i.Completed...)
+	return &c
+}
+
+// Queue is a persistent job queue on top of store.Service with at-least-once delivery semantics.
+// Leased items are owned by a worker while it keeps sending heartbeats, expired leases are handed
+// over to the next worker asking for work.
+type Queue struct {
+	store    store.Service
+	leaseTTL time.Duration
+	weights  map[string]int
+	// mu serializes read-modify-write cycles on items within the process
+	mu sync.Mutex
+}
+
+// Option configures Queue.
+type Option func(*Queue)
+
+// WithLeaseTTL sets lease duration, durations shorter than a millisecond leave the default.
+func WithLeaseTTL(ttl time.Duration) Option {
+	return func(q *Queue) {
+		if ttl >= minLeaseTTL {
+			q.leaseTTL = ttl
+		}
+	}
+}
+
+// WithTenantWeights sets tenants' shares of leased items, tenants not listed have weight 1.
+func WithTenantWeights(weights map[string]int) Option {
+	return func(q *Queue) {
+		q.weights = weights
+	}
+}
+
+// New creates new queue persisted in provided data store.
+func New(store store.Service, opts ...Option) *Queue {
+	q := &Queue{
+		store:    store,
+		leaseTTL: DefaultLeaseTTL,
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// LeaseTTL returns lease duration.
+func (q *Queue) LeaseTTL() time.Duration {
+	return q.leaseTTL
+}
+
+// Submit persists new job for later execution and returns its item id.
+func (q *Queue) Submit(ctx context.Context, spec component.JobSpec) (string, error) {
+	item := &Item{
+		ItemID:      generator.NewID(),
+		Spec:        spec,
+		State:       StatePending,
+		SubmittedAt: time.Now(),
+	}
+	if err := q.store.Create(ctx, item); err != nil {
+		return "", err
+	}
+	return item.ItemID, nil
+}
+
+// Lease hands over the next item to the worker. Items already leased by the same worker are returned first,
+// so restarted worker picks up where it left off; then pending or expired items are leased in fair-share
+// order of their tenants and priorities.
+// ErrEmpty is returned if there is nothing to do.
+func (q *Queue) Lease(ctx context.Context, owner string) (*Lease, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Data store able to lock items lets workers lease different ones concurrently
+	if c, ok := q.store.(store.Claimer); ok {
+		return q.claim(ctx, c, owner)
+	}
+
+	// Conflict means another worker sharing the data store leased the item first
+	for i := 0; ; i++ {
+		l, err := q.lease(ctx, owner)
+		if err != store.ErrConflict || i == maxConflicts {
+			return l, err
+		}
+	}
+}
+
+// maxConflicts is number of times queue operation is retried after losing race to another worker.
+const maxConflicts = 5
+
+// lease makes single attempt to lease the next item, must be called with q.mu held.
+func (q *Queue) lease(ctx context.Context, owner string) (*Lease, error) {
+	items, err := q.items(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var next *Item
+	for _, it := range items {
+		if it.State == StateLeased && it.Owner == owner {
+			next = it
+			break
+		}
+	}
+	if next == nil {
+		next = q.pick(items, now)
+	}
+	if next == nil {
+		return nil, ErrEmpty
+	}
+
+	item := q.acquire(next, owner, now)
+	if err := q.store.Update(ctx, item.ItemID, item); err != nil {
+		return nil, err
+	}
+	leased(next)
+	return &Lease{q: q, item: item.clone()}, nil
+}
+
+// claim leases the next item under data store's row locks, must be called with q.mu held. Items already
+// leased by the worker are returned first.
+func (q *Queue) claim(ctx context.Context, c store.Claimer, owner string) (*Lease, error) {
+	now := time.Now()
+	var prev *Item
+	next := func(query store.Query) (*Item, error) {
+		query.Kind = itemKind
+		rec, err := c.Claim(ctx, query, func(rec store.Record) store.Record {
+			it, ok := rec.(*Item)
+			if !ok {
+				return nil
+			}
+			prev = it
+			return q.acquire(it, owner, now)
+		})
+		if rec == nil || err != nil {
+			return nil, err
+		}
+		return rec.(*Item), nil
+	}
+	// Waiting items are pending ones and those whose lease expired
+	waiting := store.Query{Status: live, Free: now}
+
+	item, err := next(store.Query{Status: []component.Status{component.Status(StateLeased)}, Owner: owner})
+	// Item picked by fair share may be claimed by another worker first, then the pick is repeated
+	var want *Item
+	for i := 0; err == nil && item == nil && i <= maxConflicts; i++ {
+		var items []*Item
+		if items, err = q.items(ctx); err != nil {
+			break
+		}
+		if want = q.pick(items, now); want == nil {
+			break
+		}
+		query := waiting
+		query.ID = want.ItemID
+		item, err = next(query)
+	}
+	if err == nil && item == nil && want != nil {
+		// Heavily contended queue still makes progress, the next lease restores fair-share order
+		item, err = next(waiting)
+	}
+	switch {
+	case err != nil:
+		return nil, err
+	case item == nil:
+		return nil, ErrEmpty
+	}
+	leased(prev)
+	return &Lease{q: q, item: item.clone()}, nil
+}
+
+// pick returns waiting item which is leased next: tenants get items in proportion to their weights, taking
+// items they already have leased into account, and items of the same tenant go by priority, then in
+// submission order. Nil is returned if no item is waiting.
+func (q *Queue) pick(items []*Item, now time.Time) *Item {
+	// Data stores return items in no particular order, the queue keeps them in order of submission
+	items = append([]*Item(nil), items...)
+	sort.SliceStable(items, func(i, k int) bool {
+		if !items[i].SubmittedAt.Equal(items[k].SubmittedAt) {
+			return items[i].SubmittedAt.Before(items[k].SubmittedAt)
+		}
+		return items[i].ItemID < items[k].ItemID
+	})
+
+	fs := fairshare.New(q.weights)
+	for _, it := range items {
+		e := &fairshare.Entry{
+			ID:    it.ItemID,
+			Class: fairshare.Class{Tenant: it.Spec.Tenant, Priority: it.Spec.Priority},
+			Value: it,
+		}
+		switch {
+		case it.waiting(now):
+			fs.Push(e)
+		case it.State == StateLeased:
+			fs.Push(e)
+			fs.Start(e)
+		}
+	}
+	order := fs.Order()
+	if len(order) == 0 {
+		return nil
+	}
+	return order[0].Value.(*Item)
+}
+
+// acquire returns copy of the item leased by the worker.
+func (q *Queue) acquire(it *Item, owner string, now time.Time) *Item {
+	item := it.clone()
+	item.State = StateLeased
+	item.Owner = owner
+	item.LeaseUntil = now.Add(q.leaseTTL)
+	item.Attempts++
+	return item
+}
+
+// leased updates metrics once item in provided previous state was leased.
+func leased(prev *Item) {
+	if prev.Attempts > 0 {
+		retries.With().Inc()
+	}
+}
+
+// Depth returns number of items waiting to be leased, including ones with expired leases.
+func (q *Queue) Depth(ctx context.Context) (int, error) {
+	items, err := q.items(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return depth(items, time.Now()), nil
+}
+
+// depth returns number of provided items waiting to be leased by the time.
+func depth(items []*Item, now time.Time) int {
+	n := 0
+	for _, it := range items {
+		if it.waiting(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// live lists states of items which are not completed yet.
+var live = []component.Status{component.Status(StatePending), component.Status(StateLeased)}
+
+// items fetches items which are not completed yet from data store page by page, queue depth gauge is set
+// from them.
+func (q *Queue) items(ctx context.Context) ([]*Item, error) {
+	var items []*Item
+	query := store.Query{Kind: itemKind, Status: live}
+	for {
+		page, err := q.store.Find(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page.Records {
+			if it, ok := r.(*Item); ok {
+				items = append(items, it)
+			}
+		}
+		if page.Next == "" {
+			break
+		}
+		query.Cursor = page.Next
+	}
+
+	queueDepth.With().Set(float64(depth(items, time.Now())))
+	return items, nil
+}
+
+// modify applies fn to the stored copy of leased item, provided the lease is still held by the owner.
+func (q *Queue) modify(ctx context.Context, owner string, id string, fn func(*Item)) (*Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Item changed concurrently is read again, lease might have been taken over meanwhile
+	for i := 0; ; i++ {
+		item, err := q.tryModify(ctx, owner, id, fn)
+		if err != store.ErrConflict || i == maxConflicts {
+			return item, err
+		}
+	}
+}
+
+// tryModify makes single read-modify-write attempt, must be called with q.mu held.
+func (q *Queue) tryModify(ctx context.Context, owner string, id string, fn func(*Item)) (*Item, error) {
+	rec, err := q.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	stored, ok := rec.(*Item)
+	if !ok || stored.State != StateLeased || stored.Owner != owner {
+		return nil, ErrLeaseLost
+	}
+
+	item := stored.clone()
+	fn(item)
+	if err := q.store.Update(ctx, id, item); err != nil {
+		return nil, err
+	}
+	return item.clone(), nil
+}
+
+// Lease is a worker's temporary ownership of queued item.
+type Lease struct {
+	q    *Queue
+	mu   sync.Mutex
+	item *Item
+}
+
+// Item returns a snapshot of leased item.
+func (l *Lease) Item() Item {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return *l.item.clone()
+}
+
+// Heartbeat extends the lease. ErrLeaseLost is returned if lease already expired and was taken over.
+func (l *Lease) Heartbeat(ctx context.Context) error {
+	return l.update(ctx, func(it *Item) {
+		it.LeaseUntil = time.Now().Add(l.q.leaseTTL)
+	})
+}
+
+// Started records id of the job executing the item.
+func (l *Lease) Started(ctx context.Context, jobID string) error {
+	return l.update(ctx, func(it *Item) {
+		it.JobID = jobID
+	})
+}
+
+// Progress records successful completion of the named task, so it is not repeated on redelivery.
+func (l *Lease) Progress(ctx context.Context, task string) error {
+	return l.update(ctx, func(it *Item) {
+		it.Completed = append(it.Completed, task)
+	})
+}
+
+// Complete acknowledges the item with job's outcome and releases the lease.
+func (l *Lease) Complete(ctx context.Context, jobErr error) error {
+	return l.update(ctx, func(it *Item) {
+		it.State = StateSucceeded
+		it.Error = ""
+		if jobErr != nil {
+			it.State = StateFailed
+			it.Error = jobErr.Error()
+		}
+		it.Owner = ""
+		it.LeaseUntil = time.Time{}
+	})
+}
+
+// Release returns the item to the queue without completing it, e.g. when worker failed to start its job; the
+// error is recorded in the item, which is leased again like one with expired lease.
+func (l *Lease) Release(ctx context.Context, err error) error {
+	return l.update(ctx, func(it *Item) {
+		it.State = StatePending
+		it.Error = err.Error()
+		it.Owner = ""
+		it.LeaseUntil = time.Time{}
+	})
+}
+
+func (l *Lease) update(ctx context.Context, fn func(*Item)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	item, err := l.q.modify(ctx, l.item.Owner, l.item.ItemID, fn)
+	if err != nil {
+		return err
+	}
+	l.item = item
+	return nil
+}
@@ -0,0 +1,258 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/metrics"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/memory"
+	"github.com/caelifer/runner/service/store/sqlite"
+	"github.com/caelifer/runner/service/store/sqlstore"
+)
+
+// backends lists data stores queue is tested with, items are claimed in SQL ones.
+var backends = []struct {
+	name string
+	open func(t *testing.T) store.Service
+}{
+	{"memory", func(*testing.T) store.Service {
+		return memory.New(memory.WithLogger(logging.Discard()))
+	}},
+	{"sqlite", func(t *testing.T) store.Service {
+		s, err := sqlite.New(filepath.Join(t.TempDir(), "runner.db"), sqlstore.WithLogger(logging.Discard()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+}
+
+func submit(t *testing.T, q *Queue, names ...string) []string {
+	t.Helper()
+	ctx := context.Background()
+	var ids []string
+	for _, name := range names {
+		id, err := q.Submit(ctx, component.JobSpec{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func lease(t *testing.T, q *Queue, owner string) *Lease {
+	t.Helper()
+	l, err := q.Lease(context.Background(), owner)
+	if err != nil {
+		t.Fatalf("Lease(%v) failed: %v", owner, err)
+	}
+	return l
+}
+
+func TestLease(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			q := New(b.open(t))
+			ids := submit(t, q, "a", "b")
+
+			tests := []struct {
+				owner    string
+				item     string
+				attempts int
+				err      error
+			}{
+				// Items are leased in submission order
+				{"w1", ids[0], 1, nil},
+				{"w2", ids[1], 1, nil},
+				{"w3", "", 0, ErrEmpty},
+				// Item leased by the worker is handed back to it, e.g. after restart
+				{"w1", ids[0], 2, nil},
+			}
+			for i, tt := range tests {
+				l, err := q.Lease(ctx, tt.owner)
+				if err != tt.err {
+					t.Fatalf("%d: Lease(%v) = %v, want %v", i, tt.owner, err, tt.err)
+				}
+				if err != nil {
+					continue
+				}
+				it := l.Item()
+				if it.ItemID != tt.item || it.Attempts != tt.attempts || it.Owner != tt.owner || it.State != StateLeased {
+					t.Errorf("%d: Lease(%v) = %+v, want %v attempt %d", i, tt.owner, it, tt.item, tt.attempts)
+				}
+			}
+			if n, err := q.Depth(ctx); err != nil || n != 0 {
+				t.Errorf("Depth() = %d, %v, want 0", n, err)
+			}
+		})
+	}
+}
+
+func TestExpiredLeaseIsRedelivered(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			q := New(b.open(t), WithLeaseTTL(20*time.Millisecond))
+			id := submit(t, q, "a")[0]
+
+			first := lease(t, q, "w1")
+			if err := first.Progress(ctx, "task-1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := first.Heartbeat(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := q.Lease(ctx, "w2"); err != ErrEmpty {
+				t.Fatalf("Lease() of held item = %v, want %v", err, ErrEmpty)
+			}
+
+			time.Sleep(30 * time.Millisecond)
+			if n, err := q.Depth(ctx); err != nil || n != 1 {
+				t.Errorf("Depth() with expired lease = %d, %v, want 1", n, err)
+			}
+			second := lease(t, q, "w2")
+			it := second.Item()
+			if it.ItemID != id || it.Attempts != 2 || len(it.Completed) != 1 || it.Completed[0] != "task-1" {
+				t.Fatalf("redelivered item = %+v, want attempt 2 with task-1 completed", it)
+			}
+
+			// Previous owner learns it lost the lease
+			if err := first.Heartbeat(ctx); err != ErrLeaseLost {
+				t.Errorf("Heartbeat() of lost lease = %v, want %v", err, ErrLeaseLost)
+			}
+			if err := first.Complete(ctx, nil); err != ErrLeaseLost {
+				t.Errorf("Complete() of lost lease = %v, want %v", err, ErrLeaseLost)
+			}
+		})
+	}
+}
+
+func TestComplete(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		err   error
+		state State
+	}{
+		{nil, StateSucceeded},
+		{errors.New("task failed"), StateFailed},
+	}
+	for _, tt := range tests {
+		q := New(memory.New())
+		submit(t, q, "a")
+		l := lease(t, q, "w1")
+		if err := l.Started(ctx, "job-1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Complete(ctx, tt.err); err != nil {
+			t.Fatal(err)
+		}
+
+		it := l.Item()
+		if it.State != tt.state || it.JobID != "job-1" || it.Owner != "" || tt.err != nil && it.Error != tt.err.Error() {
+			t.Errorf("Complete(%v) left item %+v, want state %v", tt.err, it, tt.state)
+		}
+		// Completed item is never delivered again
+		if _, err := q.Lease(ctx, "w1"); err != ErrEmpty {
+			t.Errorf("Lease() after Complete(%v) = %v, want %v", tt.err, err, ErrEmpty)
+		}
+	}
+}
+
+func TestLeaseTTL(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{time.Minute, time.Minute},
+		{time.Millisecond, time.Millisecond},
+		// Workers could not keep such leases alive
+		{time.Microsecond, DefaultLeaseTTL},
+		{0, DefaultLeaseTTL},
+		{-time.Second, DefaultLeaseTTL},
+	}
+	for _, tt := range tests {
+		if got := New(memory.New(), WithLeaseTTL(tt.ttl)).LeaseTTL(); got != tt.want {
+			t.Errorf("WithLeaseTTL(%v) set %v, want %v", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestLeaseFairShare(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			q := New(b.open(t), WithTenantWeights(map[string]int{"b": 2}))
+
+			specs := []component.JobSpec{
+				{Name: "a1", Tenant: "a"},
+				{Name: "a2", Tenant: "a", Priority: 1},
+				{Name: "a3", Tenant: "a"},
+				{Name: "b1", Tenant: "b"},
+				{Name: "b2", Tenant: "b"},
+				{Name: "b3", Tenant: "b"},
+			}
+			for _, spec := range specs {
+				if _, err := q.Submit(ctx, spec); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Tenant b gets twice the share of tenant a, items of tenant a go by priority
+			want := []string{"a2", "b1", "b2", "a1", "b3", "a3"}
+			var got []string
+			for i := range want {
+				got = append(got, lease(t, q, fmt.Sprintf("w%d", i)).Item().Spec.Name)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("Lease() order = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDepth(t *testing.T) {
+	tests := []struct {
+		submitted, leased, completed int
+	}{
+		{0, 0, 0},
+		{3, 1, 1},
+		// Items are fetched page by page
+		{store.DefaultLimit + 20, 5, 2},
+	}
+	for _, b := range backends {
+		for _, tt := range tests {
+			ctx := context.Background()
+			q := New(b.open(t))
+			submit(t, q, make([]string, tt.submitted)...)
+			for i := 0; i < tt.leased; i++ {
+				l := lease(t, q, fmt.Sprintf("w%d", i))
+				if i < tt.completed {
+					if err := l.Complete(ctx, nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			want := tt.submitted - tt.leased
+			if n, err := q.Depth(ctx); err != nil || n != want {
+				t.Errorf("%v: Depth() = %d, %v, want %d", b.name, n, err, want)
+			}
+			var buf bytes.Buffer
+			metrics.Default.Write(&buf)
+			if line := fmt.Sprintf("runner_queue_depth %d\n", want); !strings.Contains(buf.String(), line) {
+				t.Errorf("%v: metrics do not report %q", b.name, line)
+			}
+		}
+	}
+}
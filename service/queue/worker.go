@@ -0,0 +1,191 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/component/job"
+	"github.com/caelifer/runner/component/task"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+)
+
+// DefaultPollInterval is how often idle worker checks the queue for new items.
+const DefaultPollInterval = time.Second
+
+// Worker leases jobs from the queue and runs them.
+type Worker struct {
+	id      string
+	queue   *Queue
+	jobOpts []job.Option
+	poll    time.Duration
+	logger  logging.Logger
+}
+
+// WorkerOption configures Worker.
+type WorkerOption func(*Worker)
+
+// WithJobOptions sets options applied to every job worker runs.
+func WithJobOptions(opts ...job.Option) WorkerOption {
+	return func(w *Worker) {
+		w.jobOpts = append(w.jobOpts, opts...)
+	}
+}
+
+// WithLogger sets worker's logger, it is also passed to jobs and their tasks.
+func WithLogger(l logging.Logger) WorkerOption {
+	return func(w *Worker) {
+		w.logger = l
+	}
+}
+
+// NewWorker creates new queue worker. Worker id must be stable across restarts, so that the worker
+// resumes items it leased before it went down.
+func NewWorker(id string, q *Queue, opts ...WorkerOption) *Worker {
+	w := &Worker{
+		id:     id,
+		queue:  q,
+		poll:   DefaultPollInterval,
+		logger: logging.Default(),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Run processes queued jobs one at a time until context is cancelled. Job interrupted by cancellation
+// stays leased and is resumed by the worker with the same id, or by any worker once the lease expires.
+func (w *Worker) Run(ctx context.Context) error {
+	for {
+		lease, err := w.queue.Lease(ctx, w.id)
+		switch {
+		case err == nil:
+			if w.process(ctx, lease) {
+				continue
+			}
+		case err != ErrEmpty:
+			w.log("", "lease-failed", 0, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.poll):
+		}
+	}
+}
+
+// process runs leased item's job while keeping the lease alive. It reports whether the job was started,
+// worker backs off before leasing again otherwise.
+func (w *Worker) process(ctx context.Context, lease *Lease) bool {
+	item := lease.Item()
+	w.log(item.ItemID, "leased", item.Attempts, nil)
+
+	// Skip tasks completed during previous attempts
+	done := make(map[string]bool, len(item.Completed))
+	for _, name := range item.Completed {
+		done[name] = true
+	}
+	var tasks []component.Task
+	for _, ts := range item.Spec.Tasks {
+		if !done[ts.Name] {
+			tasks = append(tasks, trackedTask{task.New(ts, task.WithLogger(w.logger)), lease})
+		}
+	}
+
+	opts := append([]job.Option{job.WithLogger(w.logger)}, w.jobOpts...)
+	opts = append(opts, job.WithSpec(item.Spec))
+	j, err := job.New(w.queue.store, tasks, opts...)
+	if err != nil {
+		// Job may start once data store recovers, the item is leased again by this or another worker
+		w.log(item.ItemID, "job-failed", item.Attempts, err)
+		if rerr := lease.Release(ctx, err); rerr != nil {
+			w.log(item.ItemID, "release-failed", item.Attempts, rerr)
+		}
+		return false
+	}
+	if err := lease.Started(ctx, j.ID()); err != nil {
+		w.log(item.ItemID, "lease-lost", item.Attempts, err)
+		return false
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Keep the lease alive while job is running
+	lost := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(w.queue.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-ticker.C:
+				if err := lease.Heartbeat(runCtx); err == ErrLeaseLost {
+					close(lost)
+					cancel()
+					return
+				} else if err != nil {
+					w.log(item.ItemID, "heartbeat-failed", item.Attempts, err)
+				}
+			}
+		}
+	}()
+
+	err = j.Run(runCtx)
+
+	select {
+	case <-lost:
+		w.log(item.ItemID, "lease-lost", item.Attempts, nil)
+		return true
+	default:
+	}
+	if ctx.Err() != nil {
+		// Shutting down, leave the item leased to be resumed later
+		w.log(item.ItemID, "interrupted", item.Attempts, ctx.Err())
+		return true
+	}
+
+	if cerr := lease.Complete(ctx, err); cerr != nil {
+		w.log(item.ItemID, "complete-failed", item.Attempts, cerr)
+		return true
+	}
+	w.log(item.ItemID, "completed", item.Attempts, err)
+	return true
+}
+
+func (w *Worker) log(item, event string, attempt int, err error) {
+	args := []interface{}{"component", "worker", "worker", w.id, "item", item, "event", event, "attempt", attempt}
+	if err != nil {
+		w.logger.Error("queue "+event, append(args, "error", err.Error())...)
+		return
+	}
+	w.logger.Info("queue "+event, args...)
+}
+
+// trackedTask records successful completion of the wrapped task in the lease.
+type trackedTask struct {
+	component.Task
+	lease *Lease
+}
+
+// Execute runs the wrapped task and records its progress.
+func (t trackedTask) Execute(ctx context.Context) error {
+	if err := t.Task.Execute(ctx); err != nil {
+		return err
+	}
+	// Failing to record progress only means the task is repeated on redelivery
+	_ = t.lease.Progress(ctx, t.Name())
+	return nil
+}
+
+// Record returns wrapped task's state to be persisted, or nil if the task can't describe it.
+func (t trackedTask) Record() *store.TaskRecord {
+	if r, ok := t.Task.(interface{ Record() *store.TaskRecord }); ok {
+		return r.Record()
+	}
+	return nil
+}
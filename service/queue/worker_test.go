@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/memory"
+)
+
+// failingWrites makes new records fail to be written while it is set.
+type failingWrites struct {
+	mu   sync.Mutex
+	fail bool
+}
+
+func (f *failingWrites) set(fail bool) {
+	f.mu.Lock()
+	f.fail = fail
+	f.mu.Unlock()
+}
+
+func (f *failingWrites) middleware(ctx context.Context, op *store.Operation, next func(ctx context.Context) error) error {
+	f.mu.Lock()
+	fail := f.fail
+	f.mu.Unlock()
+	if fail && (op.Name == "create" || op.Name == "commit") {
+		return errors.New("connection refused")
+	}
+	return next(ctx)
+}
+
+// item reads queued item from data store.
+func item(t *testing.T, s store.Service, id string) *Item {
+	t.Helper()
+	rec, err := s.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.(*Item)
+}
+
+func TestWorkerJobNotStarted(t *testing.T) {
+	f := &failingWrites{}
+	s := store.Use(memory.New(memory.WithLogger(logging.Discard())), f.middleware)
+	q := New(s)
+	id, err := q.Submit(context.Background(), component.JobSpec{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newWorker := func() *Worker {
+		w := NewWorker("w1", q, WithLogger(logging.Discard()))
+		w.poll = 10 * time.Millisecond
+		return w
+	}
+
+	// Job can't be recorded, the worker backs off instead of leasing the item over and over
+	f.set(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	err = newWorker().Run(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Run() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	it := item(t, s, id)
+	if it.Attempts < 1 || it.Attempts > 20 {
+		t.Errorf("item leased %d times, want backoff between attempts", it.Attempts)
+	}
+	if it.State != StatePending || it.Owner != "" || !strings.Contains(it.Error, "connection refused") {
+		t.Errorf("item not started = %+v, want released with error", it)
+	}
+
+	// Job runs once data store recovered
+	f.set(false)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go newWorker().Run(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for item(t, s, id).State != StateSucceeded {
+		if time.Now().After(deadline) {
+			t.Fatalf("item = %+v, want succeeded", item(t, s, id))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,283 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/metrics"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/workspace"
+)
+
+// DefaultInterval is how often collector removes job history which is out of retention.
+const DefaultInterval = time.Hour
+
+var removed = metrics.NewCounter("runner_gc_removed_total", "Number of records and workspaces removed by garbage collector.", "kind")
+
+// Policy defines how long history of finished jobs is kept. Job is removed once any of the limits is exceeded,
+// zero value of a limit disables it. Jobs which have not finished yet are never removed.
+type Policy struct {
+	// KeepLast is number of the latest runs of every job, by spec hash, which are kept. Runs recorded without
+	// spec hash are grouped by job name.
+	KeepLast int
+	// Succeeded is how long succeeded jobs are kept after they finished.
+	Succeeded time.Duration
+	// Failed is how long jobs which did not succeed are kept after they finished.
+	Failed time.Duration
+}
+
+// Enabled reports whether policy removes anything.
+func (p Policy) Enabled() bool {
+	return p.KeepLast > 0 || p.Succeeded > 0 || p.Failed > 0
+}
+
+// reason explains why job is out of retention given its rank among runs of the same job, newest first;
+// empty reason means job is kept.
+func (p Policy) reason(rec *store.JobRecord, rank int, now time.Time) string {
+	if !rec.Status.Finished() {
+		return ""
+	}
+	if p.KeepLast > 0 && rank >= p.KeepLast {
+		return fmt.Sprintf("beyond last %d runs", p.KeepLast)
+	}
+
+	ttl := p.Failed
+	if rec.Status == component.StatusSucceeded {
+		ttl = p.Succeeded
+	}
+	finished := rec.FinishedAt
+	if finished.IsZero() {
+		finished = rec.CreatedAt
+	}
+	if ttl > 0 && now.Sub(finished) > ttl {
+		return fmt.Sprintf("%v for more than %v", rec.Status, ttl)
+	}
+	return ""
+}
+
+// Removal describes job removed, or in dry run to be removed, from history.
+type Removal struct {
+	JobID     string
+	Name      string
+	Status    component.Status
+	Finished  time.Time
+	Reason    string
+	Tasks     int
+	Workspace bool
+}
+
+// Report summarizes single garbage collection pass.
+type Report struct {
+	DryRun   bool
+	Scanned  int
+	Removals []Removal
+}
+
+// Collector removes history of jobs which is out of retention: job records, records of their tasks and their
+// kept workspaces.
+type Collector struct {
+	store      store.Service
+	policy     Policy
+	workspaces *workspace.Manager
+	interval   time.Duration
+	dryRun     bool
+	logger     logging.Logger
+}
+
+// Option configures Collector.
+type Option func(*Collector)
+
+// WithWorkspaces makes collector remove workspaces kept by provided manager.
+func WithWorkspaces(m *workspace.Manager) Option {
+	return func(c *Collector) {
+		c.workspaces = m
+	}
+}
+
+// WithInterval sets how often collector runs.
+func WithInterval(d time.Duration) Option {
+	return func(c *Collector) {
+		c.interval = d
+	}
+}
+
+// WithDryRun makes collector only report what would be removed.
+func WithDryRun() Option {
+	return func(c *Collector) {
+		c.dryRun = true
+	}
+}
+
+// WithLogger sets collector's logger.
+func WithLogger(l logging.Logger) Option {
+	return func(c *Collector) {
+		c.logger = l
+	}
+}
+
+// New creates new garbage collector of job history kept in provided data store.
+func New(store store.Service, policy Policy, opts ...Option) *Collector {
+	c := &Collector{
+		store:    store,
+		policy:   policy,
+		interval: DefaultInterval,
+		logger:   logging.Default(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.logger = c.logger.With("component", "gc")
+	return c
+}
+
+// Run collects garbage periodically until context is cancelled.
+func (c *Collector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		// Failed pass is logged and retried next time
+		_, _ = c.Collect(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect makes single garbage collection pass. Job's records are removed atomically after its workspace,
+// so that job interrupted half way is removed by the next pass. History of changes kept by data store is
+// compacted once jobs are removed, so that their data is not left behind.
+func (c *Collector) Collect(ctx context.Context) (report Report, err error) {
+	report.DryRun = c.dryRun
+	defer func(t0 time.Time) {
+		logging.Outcome(c.logger, err, "gc finished",
+			"dry_run", c.dryRun,
+			"scanned", report.Scanned,
+			"removed", len(report.Removals),
+			"duration_ms", logging.DurationMs(time.Since(t0)),
+		)
+	}(time.Now())
+
+	jobs, err := c.jobs(ctx)
+	if err != nil {
+		return
+	}
+	report.Scanned = len(jobs)
+
+	// Rank runs of the same job, newest first; ids are ULIDs, so they sort in creation order
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].JobID > jobs[k].JobID
+	})
+	ranks := make(map[string]int)
+	now := time.Now()
+	for _, rec := range jobs {
+		key := "spec:" + rec.SpecHash
+		if rec.SpecHash == "" {
+			key = "name:" + rec.Name
+		}
+		rank := ranks[key]
+		ranks[key]++
+
+		reason := c.policy.reason(rec, rank, now)
+		if reason == "" {
+			continue
+		}
+		r, err := c.remove(ctx, rec, reason)
+		if err != nil {
+			return report, fmt.Errorf("removing job %v: %v", rec.JobID, err)
+		}
+		report.Removals = append(report.Removals, r)
+	}
+
+	if !c.dryRun && len(report.Removals) > 0 {
+		if err = c.store.Compact(ctx); err != nil {
+			return report, fmt.Errorf("compacting history: %v", err)
+		}
+	}
+	return
+}
+
+// jobs fetches all job records.
+func (c *Collector) jobs(ctx context.Context) ([]*store.JobRecord, error) {
+	var jobs []*store.JobRecord
+	q := store.Query{Kind: "job"}
+	for {
+		page, err := c.store.Find(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range page.Records {
+			if j, ok := rec.(*store.JobRecord); ok {
+				jobs = append(jobs, j)
+			}
+		}
+		if page.Next == "" {
+			return jobs, nil
+		}
+		q.Cursor = page.Next
+	}
+}
+
+// remove deletes job's workspace and records, unless it is a dry run.
+func (c *Collector) remove(ctx context.Context, rec *store.JobRecord, reason string) (Removal, error) {
+	r := Removal{
+		JobID:    rec.JobID,
+		Name:     rec.Name,
+		Status:   rec.Status,
+		Finished: rec.FinishedAt,
+		Reason:   reason,
+	}
+
+	// Tasks are looked up rather than taken from job record, records of tasks which never ran may be missing
+	var ids []string
+	q := store.Query{Kind: "task", JobID: rec.JobID}
+	for {
+		page, err := c.store.Find(ctx, q)
+		if err != nil {
+			return r, err
+		}
+		for _, t := range page.Records {
+			ids = append(ids, t.ID())
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+	r.Tasks = len(ids)
+	r.Workspace = c.workspaces != nil && c.workspaces.Exists(rec.JobID)
+
+	args := []interface{}{"job_id", r.JobID, "name", r.Name, "status", r.Status, "reason", r.Reason, "tasks", r.Tasks}
+	if c.dryRun {
+		c.logger.Info("job would be removed", args...)
+		return r, nil
+	}
+
+	if r.Workspace {
+		if err := c.workspaces.Remove(rec.JobID); err != nil {
+			return r, err
+		}
+		removed.With("workspace").Inc()
+	}
+
+	tx, err := c.store.Begin(ctx)
+	if err != nil {
+		return r, err
+	}
+	tx.Delete(ids...)
+	tx.Delete(rec.JobID)
+	if err := tx.Commit(); err != nil {
+		return r, err
+	}
+	removed.With("task").Add(float64(len(ids)))
+	removed.With("job").Inc()
+
+	c.logger.Info("job removed", args...)
+	return r, nil
+}
@@ -0,0 +1,204 @@
+package retention
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/generator"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/memory"
+	"github.com/caelifer/runner/service/workspace"
+)
+
+// run describes finished or running job in history, oldest first. Job is named after its spec, version suffix
+// of the spec, e.g. "a@2", marks changed spec of the same job; runs without spec are named "legacy".
+type run struct {
+	spec   string
+	status component.Status
+	age    time.Duration
+}
+
+// history creates records of provided runs, each with one task, and returns job ids by run index.
+func history(t *testing.T, s store.Service, runs []run) []string {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now()
+	var ids []string
+	for _, r := range runs {
+		job := &store.JobRecord{JobID: generator.NewID(), Name: strings.SplitN(r.spec, "@", 2)[0]}
+		if r.spec == "" {
+			job.Name = "legacy"
+		}
+		job.SpecHash = r.spec
+		job.Status = r.status
+		job.CreatedAt = now.Add(-r.age)
+		if r.status.Finished() {
+			job.FinishedAt = now.Add(-r.age)
+		}
+		task := &store.TaskRecord{TaskID: generator.NewID(), JobID: job.JobID, Name: "t"}
+		if err := s.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Create(ctx, task); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.JobID)
+	}
+	return ids
+}
+
+func TestCollect(t *testing.T) {
+	succeeded, failed, running := component.StatusSucceeded, component.StatusFailed, component.StatusRunning
+	tests := []struct {
+		name   string
+		policy Policy
+		runs   []run
+		// removed are indexes of removed runs
+		removed []int
+	}{
+		{
+			name:    "keep last runs of every job",
+			policy:  Policy{KeepLast: 2},
+			runs:    []run{{"a", succeeded, 0}, {"a", failed, 0}, {"b", succeeded, 0}, {"a", succeeded, 0}, {"a", succeeded, 0}},
+			removed: []int{0, 1},
+		},
+		{
+			name:    "runs are ranked by spec",
+			policy:  Policy{KeepLast: 1},
+			runs:    []run{{"a", succeeded, 0}, {"a", succeeded, 0}, {"a@2", succeeded, 0}},
+			removed: []int{0},
+		},
+		{
+			name:    "runs without spec are ranked by name",
+			policy:  Policy{KeepLast: 1},
+			runs:    []run{{"", succeeded, 0}, {"", failed, 0}, {"a", succeeded, 0}},
+			removed: []int{0},
+		},
+		{
+			name:    "unfinished runs are kept and count as latest",
+			policy:  Policy{KeepLast: 1},
+			runs:    []run{{"a", succeeded, 0}, {"a", running, 0}},
+			removed: []int{0},
+		},
+		{
+			name:    "succeeded ttl",
+			policy:  Policy{Succeeded: time.Hour},
+			runs:    []run{{"a", succeeded, 2 * time.Hour}, {"a", failed, 2 * time.Hour}, {"a", succeeded, time.Minute}},
+			removed: []int{0},
+		},
+		{
+			name:    "failed ttl",
+			policy:  Policy{Failed: time.Hour},
+			runs:    []run{{"a", succeeded, 2 * time.Hour}, {"a", failed, 2 * time.Hour}, {"a", failed, time.Minute}},
+			removed: []int{1},
+		},
+		{
+			name:    "any limit removes",
+			policy:  Policy{KeepLast: 2, Succeeded: time.Hour},
+			runs:    []run{{"a", failed, 0}, {"a", succeeded, 2 * time.Hour}, {"a", succeeded, 0}, {"a", running, 3 * time.Hour}},
+			removed: []int{0, 1},
+		},
+		{
+			name:   "disabled",
+			policy: Policy{},
+			runs:   []run{{"a", succeeded, 24 * time.Hour}, {"a", failed, 24 * time.Hour}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := memory.New(memory.WithLogger(logging.Discard()))
+			ids := history(t, s, tt.runs)
+
+			report, err := New(s, tt.policy, WithLogger(logging.Discard())).Collect(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Scanned != len(tt.runs) {
+				t.Errorf("scanned %d jobs, want %d", report.Scanned, len(tt.runs))
+			}
+			var got, want []string
+			for _, r := range report.Removals {
+				got = append(got, r.JobID)
+				if r.Tasks != 1 || r.Reason == "" {
+					t.Errorf("removal %+v, want one task and a reason", r)
+				}
+			}
+			for _, i := range tt.removed {
+				want = append(want, ids[i])
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("removed %v, want %v", got, want)
+			}
+
+			removed := make(map[string]bool)
+			for _, id := range want {
+				removed[id] = true
+			}
+			for _, id := range ids {
+				if _, err := s.Get(ctx, id); (err == store.ErrNotFound) != removed[id] {
+					t.Errorf("Get(%v) = %v, removed %v", id, err, removed[id])
+				}
+				page, err := s.Find(ctx, store.Query{Kind: "task", JobID: id})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (len(page.Records) == 0) != removed[id] {
+					t.Errorf("job %v has %d task records left, removed %v", id, len(page.Records), removed[id])
+				}
+			}
+
+			// History of changes holding data of removed jobs is compacted
+			_, err = s.Watch(ctx, store.Filter{Revision: 1})
+			if (err == store.ErrCompacted) != (len(want) > 0) {
+				t.Errorf("Watch() from the first revision = %v after removing %d jobs", err, len(want))
+			}
+		})
+	}
+}
+
+func TestCollectWorkspaces(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s := memory.New(memory.WithLogger(logging.Discard()))
+	ids := history(t, s, []run{{"a", component.StatusFailed, 0}, {"a", component.StatusFailed, 0}})
+	for _, id := range ids {
+		if err := os.MkdirAll(filepath.Join(root, id, "task"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws := workspace.New(root, workspace.CleanupNever)
+	policy := Policy{KeepLast: 1}
+
+	// Dry run only reports what would be removed
+	report, err := New(s, policy, WithWorkspaces(ws), WithDryRun(), WithLogger(logging.Discard())).Collect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || len(report.Removals) != 1 || report.Removals[0].JobID != ids[0] || !report.Removals[0].Workspace {
+		t.Fatalf("dry run report = %+v, want removal of %v with workspace", report, ids[0])
+	}
+	if _, err := s.Get(ctx, ids[0]); err != nil || !ws.Exists(ids[0]) {
+		t.Fatalf("dry run removed job %v: %v", ids[0], err)
+	}
+
+	if _, err := New(s, policy, WithWorkspaces(ws), WithLogger(logging.Discard())).Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ws.Exists(ids[0]) || !ws.Exists(ids[1]) {
+		t.Errorf("workspaces of %v kept %v, of %v kept %v, want only the latest kept",
+			ids[0], ws.Exists(ids[0]), ids[1], ws.Exists(ids[1]))
+	}
+	if _, err := s.Get(ctx, ids[0]); err != store.ErrNotFound {
+		t.Errorf("Get(%v) = %v, want %v", ids[0], err, store.ErrNotFound)
+	}
+}
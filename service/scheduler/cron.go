@@ -0,0 +1,318 @@
+// Parsing and matching of cron expressions is derived from github.com/robfig/cron v3, which is distributed
+// under the following license:
+//
+// Copyright (C) 2012 Rob Figueiredo
+// All Rights Reserved.
+//
+// MIT LICENSE
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed cron expression with seconds precision.
+type Cron struct {
+	second, minute, hour, dom, month, dow uint64
+	loc                                   *time.Location
+}
+
+// bounds describes valid range of values for a single cron field.
+type bounds struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	seconds = bounds{0, 59, nil}
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dows = bounds{0, 7, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// starBit marks fields specified with '*' or '?', it is needed to implement day-of-month/day-of-week semantics.
+const starBit = 1 << 63
+
+// descriptors are predefined schedules.
+var descriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// ParseCron parses cron expression in provided location. Expression has six space separated fields
+// (second, minute, hour, day of month, month, day of week); the classic five field form runs at second zero.
+// Expression may be prefixed with "CRON_TZ=<zone>" or "TZ=<zone>" which overrides provided location.
+func ParseCron(expr string, loc *time.Location) (*Cron, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	spec := strings.TrimSpace(expr)
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.IndexAny(spec, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("cron %q: missing schedule after time zone", expr)
+		}
+		zone := spec[strings.Index(spec, "=")+1 : i]
+		l, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expr, err)
+		}
+		loc, spec = l, strings.TrimSpace(spec[i:])
+	}
+	if d, ok := descriptors[spec]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("cron %q: expected 5 or 6 fields, got %d", expr, len(fields))
+	}
+
+	c := &Cron{loc: loc}
+	for i, f := range []struct {
+		bits *uint64
+		b    bounds
+	}{
+		{&c.second, seconds},
+		{&c.minute, minutes},
+		{&c.hour, hours},
+		{&c.dom, doms},
+		{&c.month, months},
+		{&c.dow, dows},
+	} {
+		bits, err := parseField(fields[i], f.b)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expr, err)
+		}
+		*f.bits = bits
+	}
+	// Sunday can be specified both as 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	return c, nil
+}
+
+// parseField parses comma separated list of ranges into a bit set.
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, expr := range strings.Split(field, ",") {
+		r, err := parseRange(expr, b)
+		if err != nil {
+			return 0, err
+		}
+		bits |= r
+	}
+	return bits, nil
+}
+
+// parseRange parses single range expression: '*', '?', 'n', 'n-m' optionally followed by '/step'.
+func parseRange(expr string, b bounds) (uint64, error) {
+	var (
+		lo, hi uint
+		step   uint = 1
+		extra  uint64
+		err    error
+	)
+
+	rangeAndStep := strings.Split(expr, "/")
+	if len(rangeAndStep) > 2 {
+		return 0, fmt.Errorf("invalid range %q", expr)
+	}
+	lowAndHigh := strings.Split(rangeAndStep[0], "-")
+	if len(lowAndHigh) > 2 {
+		return 0, fmt.Errorf("invalid range %q", expr)
+	}
+
+	switch {
+	case lowAndHigh[0] == "*" || lowAndHigh[0] == "?":
+		if len(lowAndHigh) > 1 {
+			return 0, fmt.Errorf("invalid range %q", expr)
+		}
+		lo, hi = b.min, b.max
+		if len(rangeAndStep) == 1 {
+			extra = starBit
+		}
+	default:
+		if lo, err = parseValue(lowAndHigh[0], b); err != nil {
+			return 0, err
+		}
+		hi = lo
+		if len(lowAndHigh) == 2 {
+			if hi, err = parseValue(lowAndHigh[1], b); err != nil {
+				return 0, err
+			}
+		} else if len(rangeAndStep) == 2 {
+			// 'n/step' means from n till the end of the range
+			hi = b.max
+		}
+	}
+
+	if len(rangeAndStep) == 2 {
+		v, err := strconv.ParseUint(rangeAndStep[1], 10, 8)
+		if err != nil || v == 0 {
+			return 0, fmt.Errorf("invalid step in %q", expr)
+		}
+		step = uint(v)
+	}
+
+	if lo < b.min || hi > b.max || lo > hi {
+		return 0, fmt.Errorf("range %q is out of bounds [%d, %d]", expr, b.min, b.max)
+	}
+
+	var bits uint64
+	for v := lo; v <= hi; v += step {
+		bits |= 1 << v
+	}
+	return bits | extra, nil
+}
+
+// parseValue parses single field value, either numeric or symbolic name.
+func parseValue(s string, b bounds) (uint, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return uint(v), nil
+}
+
+// Location returns time zone schedule is evaluated in.
+func (c *Cron) Location() *time.Location {
+	return c.loc
+}
+
+// Next returns the earliest activation time strictly after t, or zero time if there is none within next five years.
+func (c *Cron) Next(t time.Time) time.Time {
+	origLoc := t.Location()
+	t = t.In(c.loc)
+
+	// Start from the next whole second
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+
+	// Once a field is advanced, all lower fields are reset to their minimum value
+	added := false
+	yearLimit := t.Year() + 5
+
+wrap:
+	for t.Year() <= yearLimit {
+		for 1<<uint(t.Month())&c.month == 0 {
+			if !added {
+				added = true
+				t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, c.loc)
+			}
+			t = t.AddDate(0, 1, 0)
+			if t.Month() == time.January {
+				continue wrap
+			}
+		}
+
+		for !c.dayMatches(t) {
+			if !added {
+				added = true
+				t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, c.loc)
+			}
+			t = t.AddDate(0, 0, 1)
+			// Compensate for daylight saving time shifts
+			if t.Hour() != 0 {
+				if t.Hour() > 12 {
+					t = t.Add(time.Duration(24-t.Hour()) * time.Hour)
+				} else {
+					t = t.Add(time.Duration(-t.Hour()) * time.Hour)
+				}
+			}
+			if t.Day() == 1 {
+				continue wrap
+			}
+		}
+
+		for 1<<uint(t.Hour())&c.hour == 0 {
+			if !added {
+				added = true
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, c.loc)
+			}
+			t = t.Add(time.Hour)
+			if t.Hour() == 0 {
+				continue wrap
+			}
+		}
+
+		for 1<<uint(t.Minute())&c.minute == 0 {
+			if !added {
+				added = true
+				t = t.Truncate(time.Minute)
+			}
+			t = t.Add(time.Minute)
+			if t.Minute() == 0 {
+				continue wrap
+			}
+		}
+
+		for 1<<uint(t.Second())&c.second == 0 {
+			if !added {
+				added = true
+				t = t.Truncate(time.Second)
+			}
+			t = t.Add(time.Second)
+			if t.Second() == 0 {
+				continue wrap
+			}
+		}
+
+		return t.In(origLoc)
+	}
+
+	return time.Time{}
+}
+
+// dayMatches implements classic cron semantics: if both day of month and day of week are restricted,
+// the day matches when either of them matches.
+func (c *Cron) dayMatches(t time.Time) bool {
+	domMatch := 1<<uint(t.Day())&c.dom > 0
+	dowMatch := 1<<uint(t.Weekday())&c.dow > 0
+	if c.dom&starBit > 0 || c.dow&starBit > 0 {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,69 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database is not available: %v", err)
+	}
+	// Monday
+	from := time.Date(2026, 10, 19, 15, 4, 5, 500, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * * *", time.Date(2026, 10, 19, 15, 4, 6, 0, time.UTC)},
+		{"5-10/2 * * * * *", time.Date(2026, 10, 19, 15, 4, 7, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 19, 15, 15, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 10, 19, 16, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)},
+		{"30 0 0 1 JAN *", time.Date(2027, 1, 1, 0, 0, 30, 0, time.UTC)},
+		// Restricted day of month and day of week match either of them
+		{"0 0 13 * fri", time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 feb *", time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"CRON_TZ=America/New_York 0 9 * * *", time.Date(2026, 10, 20, 9, 0, 0, 0, ny)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr, time.UTC)
+		if err != nil {
+			t.Errorf("ParseCron(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := c.Next(from); !got.Equal(tt.want) {
+			t.Errorf("ParseCron(%q).Next(%v) = %v, want %v", tt.expr, from, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * * *",
+		"* * 24 * * *",
+		"* * * 0 * *",
+		"* * * * 13 *",
+		"* * * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"1-2-3 * * * *",
+		"1/2/3 * * * *",
+		"*-5 * * * *",
+		"* * * * foo",
+		"CRON_TZ=UTC",
+		"TZ=Nowhere/Zone * * * * *",
+	} {
+		if _, err := ParseCron(expr, time.UTC); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want error", expr)
+		}
+	}
+}
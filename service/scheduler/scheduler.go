@@ -0,0 +1,277 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/component/job"
+	"github.com/caelifer/runner/component/task"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+)
+
+// OverlapPolicy defines what happens when schedule fires while its previous run is still in progress.
+type OverlapPolicy int
+
+// Supported overlap policies.
+const (
+	// OverlapSkip drops the new run.
+	OverlapSkip OverlapPolicy = iota
+	// OverlapQueue starts the new run as soon as the previous one finishes.
+	OverlapQueue
+	// OverlapCancelPrevious cancels the previous run and starts the new one.
+	OverlapCancelPrevious
+)
+
+// Exported errors.
+var (
+	// ErrDuplicateID error is returned when schedule with the same id is already registered.
+	ErrDuplicateID = errors.New("duplicate schedule id")
+)
+
+// Schedule describes recurring job.
+type Schedule struct {
+	// ID identifies schedule, it is recorded with every triggered job.
+	ID string
+	// Expr is a cron expression, see ParseCron.
+	Expr string
+	// Location is a time zone expression is evaluated in, defaults to local time.
+	Location *time.Location
+	// Spec describes job to run.
+	Spec component.JobSpec
+	// Overlap defines what to do if previous run is still in progress.
+	Overlap OverlapPolicy
+}
+
+// Scheduler triggers jobs according to their schedules.
+type Scheduler struct {
+	store   store.Service
+	jobOpts []job.Option
+	logger  logging.Logger
+
+	mu      sync.Mutex
+	ctx     context.Context
+	wg      sync.WaitGroup
+	entries map[string]*entry
+}
+
+// entry is an internal per-schedule state.
+type entry struct {
+	Schedule
+	cron   *Cron
+	stop   context.CancelFunc
+	mu     sync.Mutex
+	cancel context.CancelFunc // cancels current run
+	done   chan struct{}      // closed when current run finishes
+	queued int
+}
+
+// Option configures Scheduler.
+type Option func(*Scheduler)
+
+// WithJobOptions sets options applied to every triggered job.
+func WithJobOptions(opts ...job.Option) Option {
+	return func(s *Scheduler) {
+		s.jobOpts = append(s.jobOpts, opts...)
+	}
+}
+
+// WithLogger sets scheduler's logger, it is also passed to triggered jobs and their tasks.
+func WithLogger(l logging.Logger) Option {
+	return func(s *Scheduler) {
+		s.logger = l
+	}
+}
+
+// New creates new scheduler.
+func New(store store.Service, opts ...Option) *Scheduler {
+	s := &Scheduler{
+		store:   store,
+		logger:  logging.Default(),
+		entries: make(map[string]*entry),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Add registers new schedule. If scheduler is already running, schedule becomes active immediately.
+func (s *Scheduler) Add(sched Schedule) error {
+	cron, err := ParseCron(sched.Expr, sched.Location)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[sched.ID]; ok {
+		return fmt.Errorf("schedule %v: %v", sched.ID, ErrDuplicateID)
+	}
+	e := &entry{Schedule: sched, cron: cron}
+	s.entries[sched.ID] = e
+
+	if s.ctx != nil {
+		s.start(e)
+	}
+
+	return nil
+}
+
+// Remove unregisters schedule, its run in progress is cancelled.
+func (s *Scheduler) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[id]; ok {
+		if e.stop != nil {
+			e.stop()
+		}
+		delete(s.entries, id)
+	}
+}
+
+// Run activates all schedules and blocks until context is cancelled. Runs in progress are cancelled on return.
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.ctx != nil {
+		s.mu.Unlock()
+		return errors.New("scheduler is already running")
+	}
+	s.ctx = ctx
+	for _, e := range s.entries {
+		s.start(e)
+	}
+	s.mu.Unlock()
+
+	<-ctx.Done()
+	s.wg.Wait()
+
+	s.mu.Lock()
+	s.ctx = nil
+	s.mu.Unlock()
+
+	return ctx.Err()
+}
+
+// start launches schedule's timer loop, must be called with s.mu held.
+func (s *Scheduler) start(e *entry) {
+	ctx, stop := context.WithCancel(s.ctx)
+	e.stop = stop
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.loop(ctx, e)
+	}()
+}
+
+// loop waits for schedule activation times and triggers runs.
+func (s *Scheduler) loop(ctx context.Context, e *entry) {
+	// Wait for the run in progress, if any, before leaving
+	defer func() {
+		e.mu.Lock()
+		e.queued = 0
+		done := e.done
+		e.mu.Unlock()
+		if done != nil {
+			<-done
+		}
+	}()
+
+	for {
+		next := e.cron.Next(time.Now())
+		if next.IsZero() {
+			s.log(e, "exhausted", nil)
+			return
+		}
+		s.log(e, "armed", nil, "next", next.In(e.cron.Location()).Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.trigger(ctx, e)
+		}
+	}
+}
+
+// trigger starts new run honoring schedule's overlap policy.
+func (s *Scheduler) trigger(ctx context.Context, e *entry) {
+	e.mu.Lock()
+	if e.done != nil {
+		switch e.Overlap {
+		case OverlapSkip:
+			e.mu.Unlock()
+			s.log(e, "skipped", nil)
+			return
+		case OverlapQueue:
+			e.queued++
+			e.mu.Unlock()
+			s.log(e, "queued", nil)
+			return
+		case OverlapCancelPrevious:
+			cancel, done := e.cancel, e.done
+			e.mu.Unlock()
+			s.log(e, "cancelling-previous", nil)
+			cancel()
+			<-done
+			e.mu.Lock()
+		}
+	}
+	s.run(ctx, e)
+	e.mu.Unlock()
+}
+
+// run executes single job for the schedule, must be called with e.mu held.
+func (s *Scheduler) run(ctx context.Context, e *entry) {
+	tasks := make([]component.Task, 0, len(e.Spec.Tasks))
+	for _, ts := range e.Spec.Tasks {
+		tasks = append(tasks, task.New(ts, task.WithLogger(s.logger)))
+	}
+	opts := append([]job.Option{job.WithLogger(s.logger)}, s.jobOpts...)
+	opts = append(opts, job.WithSpec(e.Spec), job.WithScheduleID(e.ID))
+	j, err := job.New(s.store, tasks, opts...)
+	if err != nil {
+		s.log(e, "failed", err)
+		return
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	e.cancel, e.done = cancel, done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		s.log(e, "triggered", nil)
+		if err := j.Run(runCtx); err != nil {
+			s.log(e, "failed", err)
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.cancel, e.done = nil, nil
+		if e.queued > 0 && ctx.Err() == nil {
+			e.queued--
+			s.run(ctx, e)
+		}
+	}()
+}
+
+func (s *Scheduler) log(e *entry, event string, err error, args ...interface{}) {
+	args = append(args, "component", "scheduler", "schedule", e.ID, "event", event)
+	if err != nil {
+		s.logger.Error("schedule "+event, append(args, "error", err.Error())...)
+		return
+	}
+	s.logger.Info("schedule "+event, args...)
+}
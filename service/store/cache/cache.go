@@ -0,0 +1,315 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/metrics"
+	"github.com/caelifer/runner/service/store"
+)
+
+// Cache bounds defaults.
+const (
+	DefaultSize = 10000
+	DefaultTTL  = time.Minute
+)
+
+// rewatchDelay is how long cache waits before watching data store again after watch failed.
+const rewatchDelay = time.Second
+
+var (
+	lookups = metrics.NewCounter("runner_store_cache_lookups_total", "Number of cached record lookups by result.", "result")
+	entries = metrics.NewGauge("runner_store_cache_entries", "Number of records held by cache.")
+)
+
+// cache is a store.Service decorator caching results of Get.
+type cache struct {
+	store.Service
+	size   int
+	ttl    time.Duration
+	logger logging.Logger
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	// lru holds entries, the most recently used first
+	lru *list.List
+	// gen changes on every invalidation, lookup started before it is not cached
+	gen uint64
+}
+
+// entry is a cached record, it is kept serialized so that callers modifying records they got do not change it.
+type entry struct {
+	id      string
+	kind    string
+	data    []byte
+	rev     int64
+	expires time.Time
+}
+
+// Option configures cache.
+type Option func(*cache)
+
+// WithSize sets maximal number of cached records, the least recently used ones are evicted first.
+func WithSize(n int) Option {
+	return func(c *cache) {
+		c.size = n
+	}
+}
+
+// WithTTL sets how long record stays cached, it bounds staleness while changes can not be watched.
+func WithTTL(ttl time.Duration) Option {
+	return func(c *cache) {
+		c.ttl = ttl
+	}
+}
+
+// WithLogger sets cache's logger.
+func WithLogger(l logging.Logger) Option {
+	return func(c *cache) {
+		c.logger = l
+	}
+}
+
+// New wraps data store with cache of Get results. Cached records are invalidated when they are written
+// through the cache, as well as when data store reports their change, e.g. made by another process.
+// Changes are watched until context is cancelled, then records are no longer cached.
+// Data store which implements store.Claimer is returned as one.
+func New(ctx context.Context, s store.Service, opts ...Option) store.Service {
+	c := &cache{
+		Service: s,
+		size:    DefaultSize,
+		ttl:     DefaultTTL,
+		logger:  logging.Default(),
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.logger = c.logger.With("component", "store", "backend", "cache")
+	go c.watch(ctx)
+
+	if cl, ok := s.(store.Claimer); ok {
+		return &claimingCache{c, cl}
+	}
+	return c
+}
+
+// Create new record in data store.
+func (c *cache) Create(ctx context.Context, rec store.Record) error {
+	defer c.invalidate(rec.ID())
+	return c.Service.Create(ctx, rec)
+}
+
+// Update existing record in data store.
+func (c *cache) Update(ctx context.Context, id string, rec store.Record) error {
+	defer c.invalidate(id)
+	return c.Service.Update(ctx, id, rec)
+}
+
+// Delete existing record from data store.
+func (c *cache) Delete(ctx context.Context, id string) error {
+	defer c.invalidate(id)
+	return c.Service.Delete(ctx, id)
+}
+
+// Get retrieves record from cache, or from data store if it is not cached.
+func (c *cache) Get(ctx context.Context, id string) (store.Record, error) {
+	c.mu.Lock()
+	var cached *entry
+	if el, ok := c.items[id]; ok {
+		if e := el.Value.(*entry); time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			cached = e
+		} else {
+			c.remove(el)
+		}
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	if cached != nil {
+		if rec, err := cached.record(); err == nil {
+			lookups.With("hit").Inc()
+			return rec, nil
+		}
+	}
+
+	lookups.With("miss").Inc()
+	rec, err := c.Service.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.add(gen, rec)
+	return rec, nil
+}
+
+// Begin starts a batch of writes, records written by it are invalidated on commit.
+func (c *cache) Begin(ctx context.Context) (store.Tx, error) {
+	tx, err := c.Service.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedTx{Tx: tx, c: c}, nil
+}
+
+// add caches record fetched from data store, unless something was invalidated since the lookup started.
+func (c *cache) add(gen uint64, rec store.Record) {
+	kind, data, err := store.Marshal(rec)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || c.size <= 0 {
+		return
+	}
+	if el, ok := c.items[rec.ID()]; ok {
+		c.remove(el)
+	}
+	c.items[rec.ID()] = c.lru.PushFront(&entry{
+		id:      rec.ID(),
+		kind:    kind,
+		data:    data,
+		rev:     rec.Revision(),
+		expires: time.Now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	entries.With().Set(float64(c.lru.Len()))
+}
+
+// invalidate removes records from cache.
+func (c *cache) invalidate(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, id := range ids {
+		if el, ok := c.items[id]; ok {
+			c.remove(el)
+		}
+	}
+	entries.With().Set(float64(c.lru.Len()))
+}
+
+// clear removes all records from cache.
+func (c *cache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.items = make(map[string]*list.Element)
+	c.lru.Init()
+	entries.With().Set(0)
+}
+
+// disable removes all records from cache and stops caching new ones.
+func (c *cache) disable() {
+	c.mu.Lock()
+	c.size = 0
+	c.mu.Unlock()
+	c.clear()
+}
+
+// remove removes cache entry, must be called with c.mu held.
+func (c *cache) remove(el *list.Element) {
+	delete(c.items, el.Value.(*entry).id)
+	c.lru.Remove(el)
+}
+
+// watch invalidates records changed in data store until context is cancelled. Changes missed while watch is
+// down are unknown, so cache is cleared whenever watch starts; it is disabled once watch stops.
+func (c *cache) watch(ctx context.Context) {
+	defer c.disable()
+	for {
+		ch, err := c.Service.Watch(ctx, store.Filter{})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.logger.Warn("store cache watch failed", "error", err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(rewatchDelay):
+			}
+			continue
+		}
+		c.clear()
+		for e := range ch {
+			c.invalidate(e.ID)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (e *entry) record() (store.Record, error) {
+	rec, err := store.Unmarshal(e.kind, e.data)
+	if err != nil {
+		return nil, err
+	}
+	rec.SetRevision(e.rev)
+	return rec, nil
+}
+
+// cachedTx invalidates records it writes once it is committed.
+type cachedTx struct {
+	store.Tx
+	c *cache
+
+	mu  sync.Mutex
+	ids []string
+}
+
+func (t *cachedTx) Create(recs ...store.Record) {
+	t.add(recs...)
+	t.Tx.Create(recs...)
+}
+
+func (t *cachedTx) Update(recs ...store.Record) {
+	t.add(recs...)
+	t.Tx.Update(recs...)
+}
+
+func (t *cachedTx) Delete(ids ...string) {
+	t.mu.Lock()
+	t.ids = append(t.ids, ids...)
+	t.mu.Unlock()
+	t.Tx.Delete(ids...)
+}
+
+func (t *cachedTx) Commit() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.c.invalidate(t.ids...)
+	return t.Tx.Commit()
+}
+
+func (t *cachedTx) add(recs ...store.Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, rec := range recs {
+		t.ids = append(t.ids, rec.ID())
+	}
+}
+
+// claimingCache is a cache of data store which implements store.Claimer.
+type claimingCache struct {
+	*cache
+	claimer store.Claimer
+}
+
+// Claim claims record in data store and invalidates it.
+func (c *claimingCache) Claim(ctx context.Context, q store.Query, fn func(rec store.Record) store.Record) (store.Record, error) {
+	rec, err := c.claimer.Claim(ctx, q, fn)
+	if rec != nil {
+		c.invalidate(rec.ID())
+	}
+	return rec, err
+}
@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/memory"
+)
+
+// job returns record as if it was read at provided revision.
+func job(id, name string, rev int64) *store.JobRecord {
+	rec := &store.JobRecord{JobID: id, Name: name}
+	rec.SetRevision(rev)
+	return rec
+}
+
+// name reads name of the job through cache.
+func name(t *testing.T, s store.Service, id string) string {
+	t.Helper()
+	rec, err := s.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.(*store.JobRecord).Name
+}
+
+// eventually waits for the job read through cache to have provided name.
+func eventually(t *testing.T, s store.Service, id, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for name(t, s, id) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("cached %v is %q, want %q", id, name(t, s, id), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	tests := []struct {
+		name string
+		// write renames job "a" to "a2", either through cache or directly in backing data store
+		write func(ctx context.Context, cached, backing store.Service) error
+	}{
+		{"update through cache", func(ctx context.Context, cached, _ store.Service) error {
+			return cached.Update(ctx, "a", job("a", "a2", 1))
+		}},
+		{"transaction through cache", func(ctx context.Context, cached, _ store.Service) error {
+			tx, err := cached.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			tx.Update(job("a", "a2", 1))
+			tx.Create(job("b", "b1", 0))
+			return tx.Commit()
+		}},
+		{"update by another writer", func(ctx context.Context, _, backing store.Service) error {
+			return backing.Update(ctx, "a", job("a", "a2", 1))
+		}},
+		{"transaction by another writer", func(ctx context.Context, _, backing store.Service) error {
+			tx, err := backing.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			tx.Update(job("a", "a2", 1))
+			return tx.Commit()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backing := memory.New(memory.WithLogger(logging.Discard()))
+			cached := New(ctx, backing, WithLogger(logging.Discard()))
+			if err := cached.Create(ctx, job("a", "a1", 0)); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, cached, "a", "a1")
+
+			if err := tt.write(ctx, cached, backing); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, cached, "a", "a2")
+			if rec, err := cached.Get(ctx, "a"); err != nil || rec.Revision() != 2 {
+				t.Errorf("Get() = %v, %v, want revision 2", rec, err)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	backing := memory.New(memory.WithLogger(logging.Discard()))
+	cached := New(ctx, backing, WithLogger(logging.Discard()))
+	for _, id := range []string{"a", "b"} {
+		if err := cached.Create(ctx, job(id, id, 0)); err != nil {
+			t.Fatal(err)
+		}
+		name(t, cached, id)
+	}
+
+	if err := cached.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cached.Get(ctx, "a"); err != store.ErrNotFound {
+		t.Errorf("Get() of deleted record = %v, want %v", err, store.ErrNotFound)
+	}
+	if err := backing.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := cached.Get(ctx, "b"); err == store.ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("record deleted by another writer is still cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCachedRecordsAreCopies(t *testing.T) {
+	ctx := context.Background()
+	cached := New(ctx, memory.New(memory.WithLogger(logging.Discard())), WithLogger(logging.Discard()))
+	if err := cached.Create(ctx, job("a", "a1", 0)); err != nil {
+		t.Fatal(err)
+	}
+	first, err := cached.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.(*store.JobRecord).Name = "changed"
+	if got := name(t, cached, "a"); got != "a1" {
+		t.Errorf("cached record changed without write to %q", got)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	backing := memory.New(memory.WithLogger(logging.Discard()))
+	for _, id := range []string{"a", "b", "c"} {
+		if err := backing.Create(ctx, job(id, id, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := New(ctx, backing, WithSize(2), WithLogger(logging.Discard())).(*cache)
+	// Wait until watch started, it clears the cache
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		gen := c.gen
+		c.mu.Unlock()
+		if gen > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache does not watch data store")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		get    string
+		cached []string
+	}{
+		{"a", []string{"a"}},
+		{"b", []string{"b", "a"}},
+		{"a", []string{"a", "b"}},
+		// The least recently used record is evicted
+		{"c", []string{"c", "a"}},
+	}
+	for _, tt := range tests {
+		name(t, c, tt.get)
+		c.mu.Lock()
+		var got []string
+		for el := c.lru.Front(); el != nil; el = el.Next() {
+			got = append(got, el.Value.(*entry).id)
+		}
+		c.mu.Unlock()
+		if len(got) != len(tt.cached) || len(got) > 0 && (got[0] != tt.cached[0] || got[len(got)-1] != tt.cached[len(got)-1]) {
+			t.Errorf("after Get(%v) cached %v, want %v", tt.get, got, tt.cached)
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backing := memory.New(memory.WithLogger(logging.Discard()))
+	c := New(ctx, backing, WithLogger(logging.Discard())).(*cache)
+	if err := c.Create(ctx, job("a", "a1", 0)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, c, "a", "a1")
+
+	// Changes are no longer watched, so cached records would get stale
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		size, n := c.size, c.lru.Len()
+		c.mu.Unlock()
+		if size == 0 && n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache is used after its context was cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := backing.Update(context.Background(), "a", job("a", "a2", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := name(t, c, "a"); got != "a2" {
+		t.Errorf("Get() after cancel = %q, want a2", got)
+	}
+}
@@ -0,0 +1,292 @@
+package store_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/file"
+	"github.com/caelifer/runner/service/store/memory"
+	"github.com/caelifer/runner/service/store/sqlite"
+	"github.com/caelifer/runner/service/store/sqlstore"
+)
+
+// TestConformance verifies that backends which need no server behave the same.
+func TestConformance(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) (store.Service, error)
+	}{
+		{
+			name: "memory",
+			open: func(*testing.T) (store.Service, error) {
+				return memory.New(memory.WithLogger(logging.Discard())), nil
+			},
+		},
+		{
+			name: "file",
+			open: func(t *testing.T) (store.Service, error) {
+				return file.New(t.TempDir(), file.WithLogger(logging.Discard()))
+			},
+		},
+		{
+			name: "sqlite",
+			open: func(t *testing.T) (store.Service, error) {
+				return sqlite.New(filepath.Join(t.TempDir(), "runner.db"),
+					sqlstore.WithLogger(logging.Discard()), sqlstore.WithPollInterval(10*time.Millisecond))
+			},
+		},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			s, err := b.open(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Run("revisions", func(t *testing.T) { testRevisions(t, s) })
+			t.Run("watch", func(t *testing.T) { testWatch(t, s) })
+			t.Run("compact", func(t *testing.T) { testCompact(t, s) })
+		})
+	}
+}
+
+// job returns record as if it was read at provided revision.
+func job(id, name string, rev int64) *store.JobRecord {
+	rec := &store.JobRecord{JobID: id, Name: name}
+	rec.SetRevision(rev)
+	return rec
+}
+
+func testRevisions(t *testing.T, s store.Service) {
+	ctx := context.Background()
+	rec := job("rev-a", "a1", 0)
+	if err := s.Create(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Revision() != 1 {
+		t.Errorf("created record has revision %d, want 1", rec.Revision())
+	}
+	if err := s.Create(ctx, job("rev-a", "", 0)); err != store.ErrAlreadyExists {
+		t.Errorf("Create(duplicate) = %v, want %v", err, store.ErrAlreadyExists)
+	}
+	if got := get(t, s, "rev-a"); got.Revision() != 1 || got.Name != "a1" {
+		t.Fatalf("Get() = %+v, want revision 1 of a1", got)
+	}
+
+	// Records are not shared with the store, changes take effect only once written
+	rec.Name = "changed"
+	get(t, s, "rev-a").Name = "changed"
+	if got := get(t, s, "rev-a"); got.Name != "a1" {
+		t.Fatalf("Get() after changing unwritten records = %+v, want a1", got)
+	}
+
+	first, second := job("rev-a", "a2", 1), job("rev-a", "a3", 1)
+	if err := s.Update(ctx, first.ID(), first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Revision() != 2 {
+		t.Errorf("updated record has revision %d, want 2", first.Revision())
+	}
+
+	// Stale record conflicts, Save resolves it
+	if err := s.Update(ctx, second.ID(), second); err != store.ErrConflict {
+		t.Fatalf("Update(stale) = %v, want %v", err, store.ErrConflict)
+	}
+	if got := get(t, s, "rev-a"); got.Revision() != 2 || got.Name != "a2" {
+		t.Fatalf("Get() after conflict = %+v, want revision 2 of a2", got)
+	}
+	if err := store.Save(ctx, s, second, store.KeepNewer(second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, s, "rev-a"); got.Revision() != 3 || got.Name != "a3" {
+		t.Fatalf("Get() after save = %+v, want revision 3 of a3", got)
+	}
+
+	// Batch with conflicting write changes nothing
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Create(job("rev-b", "", 0))
+	tx.Update(first)
+	if err := tx.Commit(); err != store.ErrConflict {
+		t.Fatalf("Commit() = %v, want %v", err, store.ErrConflict)
+	}
+	if _, err := s.Get(ctx, "rev-b"); err != store.ErrNotFound {
+		t.Errorf("Get() of record created by failed batch = %v, want %v", err, store.ErrNotFound)
+	}
+
+	if err := s.Delete(ctx, "rev-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(ctx, "rev-a", second); err != store.ErrNotFound {
+		t.Errorf("Update(deleted) = %v, want %v", err, store.ErrNotFound)
+	}
+	if err := s.Delete(ctx, "rev-a"); err != store.ErrNotFound {
+		t.Errorf("Delete(deleted) = %v, want %v", err, store.ErrNotFound)
+	}
+}
+
+func testWatch(t *testing.T, s store.Service) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := s.Watch(ctx, store.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []*store.JobRecord{job("watch-a", "a1", 0), job("watch-b", "b1", 0)} {
+		if err := s.Create(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Update(ctx, "watch-a", job("watch-a", "a2", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "watch-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		typ  store.EventType
+		id   string
+		name string
+	}{
+		{store.EventCreate, "watch-a", "a1"},
+		{store.EventCreate, "watch-b", "b1"},
+		{store.EventUpdate, "watch-a", "a2"},
+		{store.EventDelete, "watch-b", "b1"},
+	}
+	var events []store.Event
+	for i, w := range want {
+		e := next(t, ch)
+		if e.Type != w.typ || e.ID != w.id || e.Record.(*store.JobRecord).Name != w.name {
+			t.Fatalf("event %d is %v of %v with %+v, want %v of %v named %v", i, e.Type, e.ID, e.Record, w.typ, w.id, w.name)
+		}
+		if i > 0 && e.Revision <= events[i-1].Revision {
+			t.Fatalf("event %d has revision %d after %d", i, e.Revision, events[i-1].Revision)
+		}
+		events = append(events, e)
+	}
+
+	// Resumed watch delivers the same events after provided revision, then new ones
+	resumed, err := s.Watch(ctx, store.Filter{Revision: events[1].Revision})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range events[2:] {
+		if e := next(t, resumed); e.Type != w.Type || e.ID != w.ID || e.Revision != w.Revision {
+			t.Fatalf("resumed watch delivered %v of %v at %d, want %v of %v at %d", e.Type, e.ID, e.Revision, w.Type, w.ID, w.Revision)
+		}
+	}
+	if err := s.Create(ctx, job("watch-c", "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []<-chan store.Event{ch, resumed} {
+		if e := next(t, ch); e.ID != "watch-c" || e.Revision <= events[3].Revision {
+			t.Fatalf("watch delivered %v of %v at %d, want create of watch-c", e.Type, e.ID, e.Revision)
+		}
+	}
+}
+
+func testCompact(t *testing.T, s store.Service) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Create(ctx, job("compact-a", "a1", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "compact-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Watch(ctx, store.Filter{Revision: 1}); err != store.ErrCompacted {
+		t.Errorf("Watch() from compacted revision = %v, want %v", err, store.ErrCompacted)
+	}
+	ch, err := s.Watch(ctx, store.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(ctx, job("compact-b", "b1", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, ch); e.ID != "compact-b" {
+		t.Errorf("Watch() after compaction delivered %v of %v, want compact-b", e.Type, e.ID)
+	}
+}
+
+func TestWatchCompacted(t *testing.T) {
+	// Backends keep at least two latest changes
+	backends := []struct {
+		name string
+		open func(t *testing.T) (store.Service, error)
+	}{
+		{
+			name: "memory",
+			open: func(*testing.T) (store.Service, error) {
+				return memory.New(memory.WithHistory(2), memory.WithLogger(logging.Discard())), nil
+			},
+		},
+		{
+			name: "file",
+			open: func(t *testing.T) (store.Service, error) {
+				return file.New(t.TempDir(), file.WithHistory(2), file.WithLogger(logging.Discard()))
+			},
+		},
+		{
+			name: "sqlite",
+			open: func(t *testing.T) (store.Service, error) {
+				return sqlite.New(filepath.Join(t.TempDir(), "runner.db"),
+					sqlstore.WithHistory(2), sqlstore.WithLogger(logging.Discard()))
+			},
+		},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, err := b.open(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"a", "b", "c", "d", "e"} {
+				if err := s.Create(ctx, job(id, "", 0)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := s.Watch(ctx, store.Filter{Revision: 1}); err != store.ErrCompacted {
+				t.Errorf("Watch() from compacted revision = %v, want %v", err, store.ErrCompacted)
+			}
+			if _, err := s.Watch(ctx, store.Filter{Revision: 4}); err != nil {
+				t.Errorf("Watch() from kept revision failed: %v", err)
+			}
+		})
+	}
+}
+
+func get(t *testing.T, s store.Service, id string) *store.JobRecord {
+	t.Helper()
+	rec, err := s.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.(*store.JobRecord)
+}
+
+func next(t *testing.T, ch <-chan store.Event) store.Event {
+	t.Helper()
+	select {
+	case e, ok := <-ch:
+		if !ok {
+			t.Fatal("watch stopped")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+	}
+	return store.Event{}
+}
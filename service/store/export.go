@@ -0,0 +1,189 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Export format, records are written as JSON lines following a header line.
+const (
+	ExportFormat  = "runner-store"
+	ExportVersion = 1
+)
+
+// ExportHeader is the first line of export.
+type ExportHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	// Revision is data store's revision when export started.
+	Revision int64 `json:"revision"`
+}
+
+// exported is a line of export holding single record.
+type exported struct {
+	Kind string          `json:"kind"`
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// importBatch is number of records imported in single transaction.
+const importBatch = 100
+
+// Export writes all records of data store to w, records are read in pages, so that export does not need to
+// hold them all. Number of exported records is returned.
+func Export(ctx context.Context, s Service, w io.Writer) (n int, err error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var q Query
+	for {
+		page, err := s.Find(ctx, q)
+		if err != nil {
+			return n, err
+		}
+		if q.Cursor == "" {
+			h := ExportHeader{Format: ExportFormat, Version: ExportVersion, ExportedAt: time.Now(), Revision: page.Revision}
+			if err := enc.Encode(h); err != nil {
+				return n, err
+			}
+		}
+		for _, rec := range page.Records {
+			kind, data, err := Marshal(rec)
+			if err != nil {
+				return n, err
+			}
+			if err := enc.Encode(exported{Kind: kind, ID: rec.ID(), Data: data}); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if page.Next == "" {
+			return n, bw.Flush()
+		}
+		q.Cursor = page.Next
+	}
+}
+
+// ImportStats counts imported records.
+type ImportStats struct {
+	Created   int
+	Updated   int
+	Unchanged int
+}
+
+// Import reads records written by Export into data store, keeping their ids. Records already present are
+// replaced by the imported state unless they are identical, so that importing the same export again
+// changes nothing. Export holding the same id twice is rejected.
+func Import(ctx context.Context, s Service, r io.Reader) (stats ImportStats, err error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var h ExportHeader
+	if err := dec.Decode(&h); err != nil {
+		return stats, fmt.Errorf("store: reading export header: %v", err)
+	}
+	if h.Format != ExportFormat {
+		return stats, fmt.Errorf("store: unknown export format %q", h.Format)
+	}
+	if h.Version < 1 || h.Version > ExportVersion {
+		return stats, fmt.Errorf("store: unsupported export version %d", h.Version)
+	}
+
+	var batch []Record
+	// seen maps ids of read records to their lines, export holds every record once
+	seen := make(map[string]int)
+	for line := 2; ; line++ {
+		var e exported
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("store: reading export line %d: %v", line, err)
+		}
+		rec, err := Unmarshal(e.Kind, e.Data)
+		if err != nil {
+			return stats, fmt.Errorf("store: export line %d: %v", line, err)
+		}
+		if rec.ID() != e.ID {
+			return stats, fmt.Errorf("store: export line %d: record id %q does not match %q", line, rec.ID(), e.ID)
+		}
+		if first, ok := seen[e.ID]; ok {
+			return stats, fmt.Errorf("store: export line %d: duplicate record id %q, first seen on line %d", line, e.ID, first)
+		}
+		seen[e.ID] = line
+
+		if batch = append(batch, rec); len(batch) == importBatch {
+			if err := importRecords(ctx, s, batch, &stats); err != nil {
+				return stats, err
+			}
+			batch = batch[:0]
+		}
+	}
+	err = importRecords(ctx, s, batch, &stats)
+	return
+}
+
+// importRecords writes batch of imported records in single transaction.
+func importRecords(ctx context.Context, s Service, recs []Record, stats *ImportStats) error {
+	if len(recs) == 0 {
+		return nil
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	var created, updated, unchanged int
+	for _, rec := range recs {
+		stored, err := s.Get(ctx, rec.ID())
+		if err == ErrNotFound {
+			tx.Create(rec)
+			created++
+			continue
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		rec.SetRevision(stored.Revision())
+		same, err := equal(rec, stored)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if same {
+			unchanged++
+			continue
+		}
+		tx.Update(rec)
+		updated++
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	stats.Created += created
+	stats.Updated += updated
+	stats.Unchanged += unchanged
+	return nil
+}
+
+// equal reports whether records have the same serialized state.
+func equal(a, b Record) (bool, error) {
+	ka, da, err := Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	kb, db, err := Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return ka == kb && bytes.Equal(da, db), nil
+}
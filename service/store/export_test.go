@@ -0,0 +1,125 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caelifer/runner/component"
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/memory"
+	"github.com/caelifer/runner/service/store/sqlite"
+	"github.com/caelifer/runner/service/store/sqlstore"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := memory.New(memory.WithLogger(logging.Discard()))
+	for i := 0; i < 3; i++ {
+		job := job(string(rune('a'+i)), "job", 0)
+		job.Status = component.StatusSucceeded
+		job.Spec = component.JobSpec{Name: "job", Tasks: []component.TaskSpec{{Name: "t", Cmd: "true"}}}
+		if err := src.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+		task := &store.TaskRecord{TaskID: job.JobID + "-t", JobID: job.JobID, Name: "t", ExitCode: 0}
+		if err := src.Create(ctx, task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Updated record is exported with its latest state
+	a := get(t, src, "a")
+	a.Name = "renamed"
+	if err := src.Update(ctx, "a", a); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := store.Export(ctx, src, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("exported %d records, want 6", n)
+	}
+	var h store.ExportHeader
+	if err := json.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&h); err != nil || h.Format != store.ExportFormat || h.Revision != 7 {
+		t.Errorf("export header = %+v, %v, want %v at revision 7", h, err, store.ExportFormat)
+	}
+
+	dst, err := sqlite.New(filepath.Join(t.TempDir(), "runner.db"), sqlstore.WithLogger(logging.Discard()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Record present in destination is replaced by imported state
+	if err := dst.Create(ctx, job("b", "stale", 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want store.ImportStats
+	}{
+		{"first import", store.ImportStats{Created: 5, Updated: 1}},
+		{"repeated import", store.ImportStats{Unchanged: 6}},
+	}
+	for _, tt := range tests {
+		stats, err := store.Import(ctx, dst, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if stats != tt.want {
+			t.Errorf("%v: Import() = %+v, want %+v", tt.name, stats, tt.want)
+		}
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		want, got := get(t, src, id), get(t, dst, id)
+		if got.Name != want.Name || got.Status != want.Status || len(got.Spec.Tasks) != 1 {
+			t.Errorf("imported %+v, want %+v", got, want)
+		}
+		rec, err := dst.Get(ctx, id+"-t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task := rec.(*store.TaskRecord); task.JobID != id {
+			t.Errorf("imported task %+v, want task of %v", task, id)
+		}
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	header := `{"format":"runner-store","version":1}` + "\n"
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"empty", "", "reading export header"},
+		{"unknown format", `{"format":"tar","version":1}`, `unknown export format "tar"`},
+		{"newer version", `{"format":"runner-store","version":2}`, "unsupported export version 2"},
+		{"malformed line", header + "{", "reading export line 2"},
+		{"unknown kind", header + `{"kind":"blob","id":"a","data":{}}`, "export line 2"},
+		{"id mismatch", header + `{"kind":"job","id":"a","data":{"id":"b"}}`, `record id "b" does not match "a"`},
+		{
+			name:  "duplicate id",
+			input: header + `{"kind":"job","id":"a","data":{"id":"a"}}` + "\n" + `{"kind":"job","id":"a","data":{"id":"a"}}`,
+			err:   `export line 3: duplicate record id "a", first seen on line 2`,
+		},
+	}
+	for _, tt := range tests {
+		s := memory.New(memory.WithLogger(logging.Discard()))
+		_, err := store.Import(context.Background(), s, strings.NewReader(tt.input))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: Import() = %v, want error containing %q", tt.name, err, tt.err)
+		}
+		// Failing batch is not written
+		if recs, err := s.GetAll(context.Background()); err != nil || len(recs) != 0 {
+			t.Errorf("%v: Import() left %d records, %v", tt.name, len(recs), err)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/memory"
+)
+
+// Files kept in data directory.
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "wal.log"
+)
+
+// SyncMode controls when written changes are flushed to stable storage.
+type SyncMode int
+
+// Sync modes.
+const (
+	// SyncAlways flushes every write before it is acknowledged.
+	SyncAlways SyncMode = iota
+	// SyncInterval flushes writes periodically, the latest of them may be lost if host crashes.
+	SyncInterval
+	// SyncNone leaves flushing to operating system.
+	SyncNone
+)
+
+// DefaultSyncInterval is how often writes are flushed in SyncInterval mode.
+const DefaultSyncInterval = time.Second
+
+// DefaultSnapshotEvery is number of logged writes after which log is compacted into snapshot.
+const DefaultSnapshotEvery = 10000
+
+// ErrCorrupted error is returned when data directory cannot be recovered.
+var ErrCorrupted = errors.New("data store files are corrupted")
+
+type config struct {
+	logger        logging.Logger
+	sync          SyncMode
+	syncInterval  time.Duration
+	snapshotEvery int
+	history       int
+}
+
+// Option configures file data store.
+type Option func(*config)
+
+// WithLogger sets data store's logger.
+func WithLogger(l logging.Logger) Option {
+	return func(c *config) {
+		c.logger = l
+	}
+}
+
+// WithSync sets when written changes are flushed to stable storage.
+func WithSync(mode SyncMode) Option {
+	return func(c *config) {
+		c.sync = mode
+	}
+}
+
+// WithSyncInterval sets how often writes are flushed in SyncInterval mode.
+func WithSyncInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.syncInterval = d
+	}
+}
+
+// WithSnapshotEvery sets number of logged writes after which log is compacted into snapshot.
+func WithSnapshotEvery(n int) Option {
+	return func(c *config) {
+		c.snapshotEvery = n
+	}
+}
+
+// WithHistory sets minimal number of latest events kept for resumed watches.
+func WithHistory(n int) Option {
+	return func(c *config) {
+		c.history = n
+	}
+}
+
+// New creates data store persisted in provided directory. Records are kept in memory, every write is appended
+// to the log before it is applied and the log is periodically compacted into snapshot of all records. State is
+// recovered from the snapshot and the log on startup, write torn by a crash is discarded. Directory must not
+// be shared by multiple processes.
+func New(dir string, opts ...Option) (store.Service, error) {
+	c := config{
+		logger:        logging.Default(),
+		sync:          SyncAlways,
+		syncInterval:  DefaultSyncInterval,
+		snapshotEvery: DefaultSnapshotEvery,
+		history:       memory.DefaultHistory,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	t0 := time.Now()
+	logger := c.logger.With("component", "store", "backend", "file", "dir", dir)
+	j := &journal{
+		dir:     dir,
+		sync:    c.sync,
+		every:   c.snapshotEvery,
+		logger:  logger,
+		records: make(map[string]entry),
+	}
+	recs, err := j.recover()
+	if err != nil {
+		return nil, fmt.Errorf("store: recovering %v: %v", dir, err)
+	}
+	logger.Info("store recovered",
+		"records", len(recs),
+		"revision", j.revision,
+		"duration_ms", logging.DurationMs(time.Since(t0)),
+	)
+	if c.sync == SyncInterval {
+		j.stop, j.stopped = make(chan struct{}), make(chan struct{})
+		go j.flush(c.syncInterval)
+	}
+
+	return memory.New(
+		memory.WithLogger(c.logger),
+		memory.WithBackend("file"),
+		memory.WithHistory(c.history),
+		memory.WithState(j.revision, recs),
+		memory.WithJournal(j),
+	), nil
+}
+
+func init() {
+	store.Register("file", open)
+}
+
+// syncModes maps values of fsync parameter to sync modes.
+var syncModes = map[string]SyncMode{
+	"always":   SyncAlways,
+	"interval": SyncInterval,
+	"none":     SyncNone,
+}
+
+// open opens data store described by URL, e.g. "file:///var/lib/runner?fsync=interval&sync_interval=100ms".
+func open(u *url.URL, logger logging.Logger) (store.Service, error) {
+	p := store.NewParams(u)
+	fsync := p.String("fsync", "always")
+	mode, ok := syncModes[fsync]
+	if !ok {
+		return nil, fmt.Errorf("invalid fsync parameter %q", fsync)
+	}
+	opts := []Option{
+		WithLogger(logger),
+		WithSync(mode),
+		WithSyncInterval(p.Duration("sync_interval", DefaultSyncInterval)),
+		WithSnapshotEvery(p.Int("snapshot_every", DefaultSnapshotEvery)),
+		WithHistory(p.Int("history", memory.DefaultHistory)),
+	}
+	if err := p.Done(); err != nil {
+		return nil, err
+	}
+	if store.Path(u) == "" {
+		return nil, errors.New("data directory is required")
+	}
+	return New(store.Path(u), opts...)
+}
+
+// entry is serialized write in the log or serialized record in the snapshot.
+type entry struct {
+	Type store.EventType `json:"type,omitempty"`
+	ID   string          `json:"id"`
+	Kind string          `json:"kind,omitempty"`
+	Rev  int64           `json:"rev,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// batch is a line of the log, it holds writes applied atomically.
+type batch struct {
+	Revision int64   `json:"revision"`
+	Ops      []entry `json:"ops"`
+}
+
+// header is the first line of the snapshot.
+type header struct {
+	Revision int64 `json:"revision"`
+	Records  int   `json:"records"`
+}
+
+// journal implements memory.Journal on top of files in data directory.
+type journal struct {
+	dir    string
+	sync   SyncMode
+	every  int
+	logger logging.Logger
+	// stop ends periodic flushing, stopped is closed once it ended
+	stop, stopped chan struct{}
+
+	mu sync.Mutex
+	f  *os.File
+	// size is length of the log's valid content
+	size int64
+	// batches is number of batches logged since the last snapshot
+	batches int
+	dirty   bool
+	// err makes journal refuse writes once the log could not be kept consistent
+	err error
+	// records and revision are serialized state of data store
+	records  map[string]entry
+	revision int64
+}
+
+// Append logs batch of writes, it implements memory.Journal interface.
+func (j *journal) Append(rev int64, ops []store.Op) error {
+	b := batch{Revision: rev, Ops: make([]entry, 0, len(ops))}
+	for _, op := range ops {
+		e := entry{Type: op.Type, ID: op.ID}
+		if op.Record != nil {
+			kind, data, err := store.Marshal(op.Record)
+			if err != nil {
+				return err
+			}
+			e.Kind, e.Rev, e.Data = kind, op.Record.Revision(), data
+		}
+		b.Ops = append(b.Ops, e)
+	}
+	line, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return j.err
+	}
+	if err := j.write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	// Update serialized state
+	for _, e := range b.Ops {
+		if e.Type == store.EventDelete {
+			delete(j.records, e.ID)
+			continue
+		}
+		e.Type = ""
+		j.records[e.ID] = e
+	}
+	j.revision = rev
+	j.batches++
+
+	// Write is already durable, failed compaction only leaves longer log behind
+	if j.batches >= j.every {
+		if err := j.snapshot(); err != nil {
+			j.logger.Error("store snapshot failed", "error", err.Error())
+		}
+	}
+	return nil
+}
+
+// Compact snapshots all records and empties the log, it implements memory.Journal interface.
+func (j *journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return j.err
+	}
+	if j.batches == 0 {
+		return nil
+	}
+	return j.snapshot()
+}
+
+// write appends line to the log, must be called with j.mu held.
+func (j *journal) write(line []byte) error {
+	if _, err := j.f.Write(line); err != nil {
+		// Partially written line would corrupt following ones
+		if terr := j.f.Truncate(j.size); terr != nil {
+			j.err = fmt.Errorf("store: log is inconsistent after failed write: %v", err)
+		}
+		return err
+	}
+	j.size += int64(len(line))
+
+	if j.sync != SyncAlways {
+		j.dirty = true
+		return nil
+	}
+	if err := j.f.Sync(); err != nil {
+		// It is unknown what reached the disk, so nothing else may be written
+		j.err = fmt.Errorf("store: flushing log: %v", err)
+		return j.err
+	}
+	return nil
+}
+
+// flush periodically flushes the log to stable storage until the journal is closed.
+func (j *journal) flush(every time.Duration) {
+	defer close(j.stopped)
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-j.stop:
+			return
+		}
+		j.mu.Lock()
+		j.fsync()
+		j.mu.Unlock()
+	}
+}
+
+// fsync flushes written lines to stable storage, must be called with j.mu held.
+func (j *journal) fsync() {
+	if !j.dirty || j.err != nil {
+		return
+	}
+	if err := j.f.Sync(); err != nil {
+		j.err = fmt.Errorf("store: flushing log: %v", err)
+		j.logger.Error("store flush failed", "error", err.Error())
+	}
+	j.dirty = false
+}
+
+// errClosed is returned by writes to closed journal.
+var errClosed = errors.New("store: closed")
+
+// Close stops periodic flushing, flushes the log and closes it, it implements memory.Journal interface.
+func (j *journal) Close() error {
+	if j.stop != nil {
+		select {
+		case <-j.stop:
+		default:
+			close(j.stop)
+		}
+		<-j.stopped
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err == errClosed {
+		return nil
+	}
+	j.fsync()
+	err := j.err
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	j.err = errClosed
+	return err
+}
+
+// snapshot writes all records into snapshot and empties the log, must be called with j.mu held.
+// Crash in between leaves logged writes the snapshot already includes, they are skipped on recovery.
+func (j *journal) snapshot() error {
+	t0 := time.Now()
+	ids := make([]string, 0, len(j.records))
+	for id := range j.records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	lines := [][]byte{}
+	h, err := json.Marshal(header{Revision: j.revision, Records: len(ids)})
+	if err != nil {
+		return err
+	}
+	lines = append(lines, h)
+	for _, id := range ids {
+		line, err := json.Marshal(j.records[id])
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	if err := writeFile(j.dir, snapshotFile, lines); err != nil {
+		return err
+	}
+
+	// Empty the log
+	if err := j.f.Truncate(0); err != nil {
+		j.err = fmt.Errorf("store: log is inconsistent after snapshot: %v", err)
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		j.err = fmt.Errorf("store: flushing log: %v", err)
+		return err
+	}
+	j.size, j.batches, j.dirty = 0, 0, false
+
+	j.logger.Info("store snapshot written",
+		"records", len(ids),
+		"revision", j.revision,
+		"duration_ms", logging.DurationMs(time.Since(t0)),
+	)
+	return nil
+}
+
+// recover loads snapshot, replays the log on top of it and opens the log for appending.
+func (j *journal) recover() ([]store.Record, error) {
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := j.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(j.dir, logFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.replay(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.f = f
+
+	recs := make([]store.Record, 0, len(j.records))
+	for _, e := range j.records {
+		rec, err := store.Unmarshal(e.Kind, e.Data)
+		if err != nil {
+			return nil, err
+		}
+		rec.SetRevision(e.Rev)
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// loadSnapshot reads records from snapshot, if there is one.
+func (j *journal) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(j.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Snapshot is replaced atomically, so it is always complete
+	r := bufio.NewReader(f)
+	var h header
+	if err := readLine(r, &h); err != nil {
+		return fmt.Errorf("%v: snapshot header: %v", ErrCorrupted, err)
+	}
+	for i := 0; i < h.Records; i++ {
+		var e entry
+		if err := readLine(r, &e); err != nil {
+			return fmt.Errorf("%v: snapshot record %d: %v", ErrCorrupted, i+1, err)
+		}
+		j.records[e.ID] = e
+	}
+	j.revision = h.Revision
+	return nil
+}
+
+// replay applies logged writes which are newer than snapshot. Write torn by a crash can only be the last one,
+// it is cut off the log.
+func (j *journal) replay(f *os.File) error {
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		var b batch
+		if err != nil || json.Unmarshal(line, &b) != nil {
+			// Torn write is followed by nothing
+			if _, perr := r.Peek(1); perr != io.EOF {
+				return fmt.Errorf("%v: log entry at offset %d", ErrCorrupted, offset)
+			}
+			j.logger.Warn("store discarding torn write", "offset", offset, "bytes", len(line))
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += int64(len(line))
+		j.batches++
+
+		if b.Revision <= j.revision {
+			continue
+		}
+		for _, e := range b.Ops {
+			if e.Type == store.EventDelete {
+				delete(j.records, e.ID)
+				continue
+			}
+			e.Type = ""
+			j.records[e.ID] = e
+		}
+		j.revision = b.Revision
+	}
+	j.size = offset
+	return nil
+}
+
+// readLine decodes single JSON line.
+func readLine(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes.TrimSpace(line), v)
+}
+
+// writeFile atomically replaces file in directory with provided lines.
+func writeFile(dir, name string, lines [][]byte) error {
+	path := filepath.Join(dir, name)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	// Make the rename durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
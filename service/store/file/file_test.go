@@ -0,0 +1,208 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/service/store"
+)
+
+func TestRecovery(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		damage func(log []byte) []byte
+		// want maps ids of recovered records to their names, nil means recovery fails
+		want map[string]string
+	}{
+		{
+			name: "intact",
+			want: map[string]string{"a": "a2", "b": "b1"},
+		},
+		{
+			name:   "torn last write",
+			damage: func(log []byte) []byte { return log[:len(log)-10] },
+			want:   map[string]string{"a": "a1", "b": "b1"},
+		},
+		{
+			name:   "last write without newline",
+			damage: func(log []byte) []byte { return log[:len(log)-1] },
+			want:   map[string]string{"a": "a1", "b": "b1"},
+		},
+		{
+			name:   "partial write appended",
+			damage: func(log []byte) []byte { return append(log, `{"revision":4,"ops":[`...) },
+			want:   map[string]string{"a": "a2", "b": "b1"},
+		},
+		{
+			name:   "torn write after snapshot",
+			opts:   []Option{WithSnapshotEvery(2)},
+			damage: func(log []byte) []byte { return log[:len(log)-10] },
+			want:   map[string]string{"a": "a1", "b": "b1"},
+		},
+		{
+			name:   "corrupted write followed by another",
+			damage: func(log []byte) []byte { return append([]byte("x"), log...) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			opts := append([]Option{WithSync(SyncNone)}, tt.opts...)
+			s, err := New(dir, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			write(t, s, "a", "a1")
+			write(t, s, "b", "b1")
+			write(t, s, "a", "a2")
+
+			if tt.damage != nil {
+				path := filepath.Join(dir, logFile)
+				log, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, tt.damage(log), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err = New(dir, opts...)
+			if tt.want == nil {
+				if err == nil || !strings.Contains(err.Error(), ErrCorrupted.Error()) {
+					t.Fatalf("New() = %v, want %v", err, ErrCorrupted)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, s, tt.want)
+
+			// Torn write is cut off the log, so that writes after recovery survive the next one
+			write(t, s, "a", "a3")
+			tt.want["a"] = "a3"
+			if s, err = New(dir, opts...); err != nil {
+				t.Fatal(err)
+			}
+			check(t, s, tt.want)
+			if _, err := s.Get(ctx, "missing"); err != store.ErrNotFound {
+				t.Errorf("Get(missing) = %v, want %v", err, store.ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := New(dir, WithSync(SyncNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, s, "a", "a1")
+	write(t, s, "b", "secret")
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleted record is left neither in the log nor in the snapshot
+	for _, name := range []string{logFile, snapshotFile} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "secret") {
+			t.Errorf("%v keeps deleted record: %s", name, data)
+		}
+	}
+	if s, err = New(dir, WithSync(SyncNone)); err != nil {
+		t.Fatal(err)
+	}
+	check(t, s, map[string]string{"a": "a1"})
+}
+
+func TestClose(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"sync always", []Option{WithSync(SyncAlways)}},
+		// Writes are flushed by Close, not by the flusher which would run much later
+		{"sync interval", []Option{WithSync(SyncInterval), WithSyncInterval(time.Hour)}},
+		{"sync none", []Option{WithSync(SyncNone)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			s, err := New(dir, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			write(t, s, "a", "a1")
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close() = %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("Close() of closed store = %v", err)
+			}
+			if err := s.Create(ctx, &store.JobRecord{JobID: "b"}); err == nil {
+				t.Error("Create() after Close() succeeded")
+			}
+
+			if s, err = New(dir, tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			check(t, s, map[string]string{"a": "a1"})
+		})
+	}
+}
+
+// write creates or updates job record with provided name.
+func write(t *testing.T, s store.Service, id, name string) {
+	t.Helper()
+	ctx := context.Background()
+	rec, err := s.Get(ctx, id)
+	switch err {
+	case store.ErrNotFound:
+		err = s.Create(ctx, &store.JobRecord{JobID: id, Name: name})
+	case nil:
+		rec.(*store.JobRecord).Name = name
+		err = s.Update(ctx, id, rec)
+	}
+	if err != nil {
+		t.Fatalf("writing %v: %v", id, err)
+	}
+}
+
+// check verifies that data store holds job records with provided names.
+func check(t *testing.T, s store.Service, want map[string]string) {
+	t.Helper()
+	recs, err := s.GetAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, rec := range recs {
+		got[rec.ID()] = rec.(*store.JobRecord).Name
+	}
+	if len(got) != len(want) {
+		t.Fatalf("recovered %v, want %v", got, want)
+	}
+	for id, name := range want {
+		if got[id] != name {
+			t.Fatalf("recovered %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Record types are registered under kind names, so that backends which serialize records can restore them
+// as the same Go types.
+var (
+	kindsMu sync.RWMutex
+	kinds   = make(map[string]reflect.Type)
+	types   = make(map[reflect.Type]string)
+)
+
+// RegisterKind registers record type of provided prototype under kind name. Prototype must be a pointer to
+// a JSON serializable struct. It panics if kind or type is already registered.
+func RegisterKind(kind string, proto Record) {
+	t := reflect.TypeOf(proto)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("store: record kind %q must be a pointer to struct, got %v", kind, t))
+	}
+
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+	if _, ok := kinds[kind]; ok {
+		panic(fmt.Sprintf("store: record kind %q is already registered", kind))
+	}
+	if k, ok := types[t]; ok {
+		panic(fmt.Sprintf("store: record type %v is already registered as %q", t, k))
+	}
+	kinds[kind] = t
+	types[t] = kind
+}
+
+// KindOf returns kind record's type is registered under.
+func KindOf(rec Record) (string, error) {
+	kindsMu.RLock()
+	defer kindsMu.RUnlock()
+	k, ok := types[reflect.TypeOf(rec)]
+	if !ok {
+		return "", fmt.Errorf("store: record type %T is not registered", rec)
+	}
+	return k, nil
+}
+
+// Marshal serializes record and returns its kind.
+func Marshal(rec Record) (kind string, data []byte, err error) {
+	if kind, err = KindOf(rec); err != nil {
+		return
+	}
+	data, err = json.Marshal(rec)
+	return
+}
+
+// Unmarshal restores record of provided kind.
+func Unmarshal(kind string, data []byte) (Record, error) {
+	kindsMu.RLock()
+	t, ok := kinds[kind]
+	kindsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("store: unknown record kind %q", kind)
+	}
+
+	rec := reflect.New(t.Elem()).Interface().(Record)
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("store: decoding %v record: %v", kind, err)
+	}
+	return rec, nil
+}
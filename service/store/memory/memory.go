@@ -1,180 +1,439 @@
 package memory
 
 import (
-	"encoding/json"
-	"errors"
-	"fmt"
+	"context"
 	"io"
-	"log"
 	"math/rand"
-	"os"
+	"net/url"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/caelifer/runner/service/logging"
 	"github.com/caelifer/runner/service/store"
 )
 
 // Exported errors.
 var (
 	// ErrNotFound error is returned when object is not found in the data store.
-	ErrNotFound = errors.New("object not found")
+	ErrNotFound = store.ErrNotFound
+	// ErrAlreadyExists error is returned when object with the same id is already in the data store.
+	ErrAlreadyExists = store.ErrAlreadyExists
 )
 
+// DefaultHistory is minimal number of latest events kept for resumed watches.
+const DefaultHistory = 1024
+
 // memoryStore is an internal type that implements store.Service interface.
 type memoryStore struct {
 	entropy io.Reader
-	logger  *log.Logger
+	logger  logging.Logger
+	backend string
+	journal Journal
+	history int
+	mu      sync.RWMutex
+	records map[string]store.Record
+	// revision is revision of the latest event, events keeps the latest of them
+	revision int64
+	events   []store.Event
+	// changed is closed and replaced on every event
+	changed chan struct{}
 }
 
-// logRec is an internal type used for structured logging.
-type logRec struct {
-	Service   string `json:"service"`
-	Operation string `json:"operation"`
-	ID        string `json:"id,omitempty"`
-	Success   bool   `json:"success,omitempty"`
-	Error     string `json:"error,omitempty"`
-	Duration  string `json:"duration"`
+// Option configures memory data store.
+type Option func(*memoryStore)
+
+// WithLogger sets data store's logger.
+func WithLogger(l logging.Logger) Option {
+	return func(ms *memoryStore) {
+		ms.logger = l
+	}
 }
 
-// String serializes structured log entry to JSON encoded string.
-func (l logRec) String() string {
-	out, _ := json.Marshal(&l)
-	return string(out)
+// WithBackend sets backend name reported in logs, metrics and traces, it is meant for data stores built on top
+// of memory one.
+func WithBackend(name string) Option {
+	return func(ms *memoryStore) {
+		ms.backend = name
+	}
+}
+
+// Journal persists writes of memory data store, so that they survive restarts.
+type Journal interface {
+	// Append persists batch of writes which advances data store to provided revision. It is called before
+	// writes are applied with records carrying their new revisions, failing it fails the writes.
+	Append(rev int64, ops []store.Op) error
+	// Compact drops persisted writes superseded by the current state, e.g. data of deleted records.
+	Compact() error
+	// Close flushes persisted writes and releases journal's resources, writes fail afterwards.
+	Close() error
+}
+
+// WithJournal makes data store persist its writes in provided journal.
+func WithJournal(j Journal) Option {
+	return func(ms *memoryStore) {
+		ms.journal = j
+	}
+}
+
+// WithState restores data store's records as of provided revision, e.g. recovered from persistent storage.
+// Watches cannot be resumed from earlier revisions.
+func WithState(rev int64, recs []store.Record) Option {
+	return func(ms *memoryStore) {
+		ms.revision = rev
+		for _, rec := range recs {
+			ms.records[rec.ID()] = rec
+		}
+	}
 }
 
-// New creates new MySQL based data store service.
-func New() store.Service {
-	logger := log.New(os.Stderr, "", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+// WithHistory sets minimal number of latest events kept for resumed watches.
+func WithHistory(n int) Option {
+	return func(ms *memoryStore) {
+		ms.history = n
+	}
+}
 
-	return &memoryStore{
-		logger:  logger,
+// New creates new memory based data store service.
+func New(opts ...Option) store.Service {
+	ms := &memoryStore{
+		logger:  logging.Default(),
+		backend: "memory",
+		history: DefaultHistory,
+		records: make(map[string]store.Record),
+		changed: make(chan struct{}),
 		entropy: rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
+	for _, opt := range opts {
+		opt(ms)
+	}
+	ms.logger = ms.logger.With("component", "store", "backend", ms.backend)
+
+	return store.Instrument(ms, ms.backend, ms.logger)
+}
+
+func init() {
+	store.Register("memory", open)
+}
+
+// open opens data store described by URL, e.g. "memory://?history=4096".
+func open(u *url.URL, logger logging.Logger) (store.Service, error) {
+	p := store.NewParams(u)
+	history := p.Int("history", DefaultHistory)
+	if err := p.Done(); err != nil {
+		return nil, err
+	}
+	return New(WithLogger(logger), WithHistory(history)), nil
 }
 
 // Create new record in data store.
-func (ms *memoryStore) Create(record store.Record) (err error) {
-	defer func(t0 time.Time) {
-		errStr := ""
+func (ms *memoryStore) Create(ctx context.Context, record store.Record) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.apply([]store.Op{{Type: store.EventCreate, ID: record.ID(), Record: record}})
+}
+
+// Update existing record in data store.
+func (ms *memoryStore) Update(ctx context.Context, id string, record store.Record) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.apply([]store.Op{{Type: store.EventUpdate, ID: id, Record: record}})
+}
+
+// Delete existing record from data store.
+func (ms *memoryStore) Delete(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.apply([]store.Op{{Type: store.EventDelete, ID: id}})
+}
+
+// Begin starts a batch of writes applied atomically.
+func (ms *memoryStore) Begin(ctx context.Context) (store.Tx, error) {
+	return store.NewTx(func(ops []store.Op) error {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+
+		return ms.apply(ops)
+	}), nil
+}
+
+// apply performs writes, must be called with ms.mu held. Writes are validated against the state preceding
+// ones would produce first, so that nothing is changed if any of them fails.
+func (ms *memoryStore) apply(ops []store.Op) error {
+	// Revisions of records changed by preceding writes, deleted records have negative revision
+	pending := make(map[string]int64)
+	revision := func(id string) (int64, bool) {
+		if rev, ok := pending[id]; ok {
+			return rev, rev >= 0
+		}
+		if rec, ok := ms.records[id]; ok {
+			return rec.Revision(), true
+		}
+		return 0, false
+	}
+
+	for _, op := range ops {
+		rev, ok := revision(op.ID)
+		switch op.Type {
+		case store.EventCreate:
+			if ok {
+				return ErrAlreadyExists
+			}
+			pending[op.ID] = 1
+		case store.EventUpdate:
+			if !ok {
+				return ErrNotFound
+			}
+			// Record must not have changed since it was read
+			if op.Record.Revision() != rev {
+				return store.ErrConflict
+			}
+			pending[op.ID] = rev + 1
+		case store.EventDelete:
+			if !ok {
+				return ErrNotFound
+			}
+			pending[op.ID] = -1
+		}
+	}
+
+	// Advance revisions of written records, data store keeps copies of them
+	revs := make([]int64, len(ops))
+	recs := make([]store.Record, len(ops))
+	restore := func() {
+		for i, op := range ops {
+			if op.Record != nil {
+				op.Record.SetRevision(revs[i])
+			}
+		}
+	}
+	for i, op := range ops {
+		switch op.Type {
+		case store.EventCreate:
+			revs[i] = op.Record.Revision()
+			op.Record.SetRevision(1)
+		case store.EventUpdate:
+			revs[i] = op.Record.Revision()
+			op.Record.SetRevision(revs[i] + 1)
+		default:
+			continue
+		}
+		rec, err := clone(op.Record)
 		if err != nil {
-			errStr = err.Error()
+			restore()
+			return err
 		}
-		ms.logger.Printf("%v",
-			logRec{
-				Service:   "memory",
-				Operation: "create",
-				ID:        record.ID(),
-				Error:     errStr,
-				Duration:  fmt.Sprintf("%v", time.Since(t0)),
-			},
-		)
-	}(time.Now())
+		recs[i] = rec
+	}
 
-	// run create op
+	// Persist writes first, nothing is changed if that fails
+	if ms.journal != nil {
+		if err := ms.journal.Append(ms.revision+int64(len(ops)), ops); err != nil {
+			restore()
+			return err
+		}
+	}
+
+	// Update state
+	for i, op := range ops {
+		switch op.Type {
+		case store.EventCreate, store.EventUpdate:
+			ms.records[op.ID] = recs[i]
+			ms.publish(op.Type, op.ID, recs[i])
+		case store.EventDelete:
+			ms.publish(op.Type, op.ID, ms.records[op.ID])
+			delete(ms.records, op.ID)
+		}
+	}
+	return nil
+}
+
+// Get retrieves record from data store based on provided id.
+func (ms *memoryStore) Get(ctx context.Context, id string) (record store.Record, err error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	record, ok := ms.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return clone(record)
+}
+
+// GetAll fetches all records from data store as a slice.
+func (ms *memoryStore) GetAll(ctx context.Context) (records []store.Record, err error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	records = make([]store.Record, 0, len(ms.records))
+	for _, r := range ms.records {
+		if r, err = clone(r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	// IDs are ULIDs, so records are returned in creation order
+	sort.Slice(records, func(i, k int) bool {
+		return records[i].ID() < records[k].ID()
+	})
 
 	return
 }
 
-// Update existing record in data store.
-func (ms *memoryStore) Update(id string, record store.Record) (err error) {
-	defer func(t0 time.Time) {
-		errStr := ""
-		if err != nil {
-			errStr = err.Error()
-		}
-		ms.logger.Printf("%v",
-			logRec{
-				Service:   "memory",
-				Operation: "update",
-				ID:        record.ID(),
-				Success:   record.Success(),
-				Error:     errStr,
-				Duration:  fmt.Sprintf("%v", time.Since(t0)),
-			},
-		)
-	}(time.Now())
-
-	// Check if object exists first
-	if !ms.isPresent(id) {
-		err = ErrNotFound
-		return
+// Find returns a page of records matching the query.
+func (ms *memoryStore) Find(ctx context.Context, q store.Query) (page store.Page, err error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	page.Revision = ms.revision
+	ids := make([]string, 0, len(ms.records))
+	for id := range ms.records {
+		if id > q.Cursor {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	limit := q.PageSize()
+	for _, id := range ids {
+		rec := ms.records[id]
+		if !q.Match(rec) {
+			continue
+		}
+		if len(page.Records) == limit {
+			page.Next = page.Records[limit-1].ID()
+			break
+		}
+		if rec, err = clone(rec); err != nil {
+			return store.Page{}, err
+		}
+		page.Records = append(page.Records, rec)
 	}
 
-	// Update state
 	return
 }
 
-// Delete existing record from data store.
-func (ms *memoryStore) Delete(id string) (err error) {
-	defer func(t0 time.Time) {
-		errStr := ""
-		if err != nil {
-			errStr = err.Error()
-		}
-		ms.logger.Printf("%v",
-			logRec{
-				Service:   "memory",
-				Operation: "delete",
-				ID:        id,
-				Error:     errStr,
-				Duration:  fmt.Sprintf("%v", time.Since(t0)),
-			},
-		)
-	}(time.Now())
-
-	// Check if object exists first
-	if !ms.isPresent(id) {
-		err = ErrNotFound
+// Watch delivers changes of records matching the filter until context is cancelled.
+func (ms *memoryStore) Watch(ctx context.Context, f store.Filter) (_ <-chan store.Event, err error) {
+	next := f.Revision
+	ms.mu.RLock()
+	if next == 0 {
+		next = ms.revision
+	}
+	_, err = ms.since(next)
+	ms.mu.RUnlock()
+	if err != nil {
 		return
 	}
 
-	// Update state
-	return
+	ch := make(chan store.Event, watchBuffer)
+	go func() {
+		defer close(ch)
+		for {
+			ms.mu.RLock()
+			events, err := ms.since(next)
+			changed := ms.changed
+			ms.mu.RUnlock()
+			if err != nil {
+				// Watcher fell behind, it has to resume
+				ms.logger.Warn("store watch fell behind", "revision", next)
+				return
+			}
+
+			for _, e := range events {
+				next = e.Revision
+				if !f.Query.Match(e.Record) {
+					continue
+				}
+				// Every watcher gets its own copy of the record
+				if e.Record, err = clone(e.Record); err != nil {
+					ms.logger.Error("store watch failed", "revision", next, "error", err.Error())
+					return
+				}
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
 }
 
-// Get retrieves record from data store based on provided id.
-func (ms *memoryStore) Get(id string) (record store.Record, err error) {
-	defer func(t0 time.Time) {
-		errStr := ""
-		if err != nil {
-			errStr = err.Error()
+// clone returns deep copy of the record, so that data store and its callers never share records.
+func clone(rec store.Record) (store.Record, error) {
+	kind, data, err := store.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return store.Unmarshal(kind, data)
+}
+
+// Compact discards events but the latest one, and compacts the journal.
+func (ms *memoryStore) Compact(ctx context.Context) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.journal != nil {
+		if err := ms.journal.Compact(); err != nil {
+			return err
 		}
-		ms.logger.Printf("%v",
-			logRec{
-				Service:   "memory",
-				Operation: "get",
-				ID:        id,
-				Error:     errStr,
-				Duration:  fmt.Sprintf("%v", time.Since(t0)),
-			},
-		)
-	}(time.Now())
+	}
+	if len(ms.events) > 1 {
+		ms.events = append(ms.events[:0:0], ms.events[len(ms.events)-1])
+	}
+	return nil
+}
 
-	// get by id
+// Close closes the journal, if there is one.
+func (ms *memoryStore) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 
-	return
+	if ms.journal != nil {
+		return ms.journal.Close()
+	}
+	return nil
 }
 
-// GetAll fetches all records from data store as a slice.
-func (ms *memoryStore) GetAll() (records []store.Record, err error) {
-	defer func(t0 time.Time) {
-		errStr := ""
-		if err != nil {
-			errStr = err.Error()
-		}
-		ms.logger.Printf("%+v",
-			logRec{
-				Service:   "memory",
-				Operation: "get-all",
-				Error:     errStr,
-				Duration:  fmt.Sprintf("%v", time.Since(t0)),
-			},
-		)
-	}(time.Now())
+// watchBuffer is number of events buffered for slow watcher.
+const watchBuffer = 64
 
-	return
+// publish records change of the record and wakes up watchers, must be called with ms.mu held.
+func (ms *memoryStore) publish(typ store.EventType, id string, record store.Record) {
+	ms.revision++
+	ms.events = append(ms.events, store.Event{Type: typ, Revision: ms.revision, ID: id, Record: record})
+	// Trim history in batches, so that it is not copied on every change
+	if len(ms.events) > 2*ms.history {
+		ms.events = append(ms.events[:0:0], ms.events[len(ms.events)-ms.history:]...)
+	}
+
+	close(ms.changed)
+	ms.changed = make(chan struct{})
 }
 
-// isPresent checks if record with given id exists in data store.
-func (ms *memoryStore) isPresent(_ string) bool {
-	return true
+// since returns events which happened after provided revision, must be called with ms.mu held.
+// ErrCompacted is returned if some of them are no longer kept.
+func (ms *memoryStore) since(rev int64) ([]store.Event, error) {
+	oldest := ms.revision - int64(len(ms.events)) + 1
+	if rev+1 < oldest {
+		return nil, store.ErrCompacted
+	}
+	if rev >= ms.revision {
+		return nil, nil
+	}
+	events := ms.events[len(ms.events)-int(ms.revision-rev):]
+	return append([]store.Event(nil), events...), nil
 }
@@ -0,0 +1,20 @@
+package store
+
+import "github.com/caelifer/runner/service/metrics"
+
+// Data store metrics shared by all backends.
+var (
+	// OperationDuration observes latency of data store operations by backend and operation.
+	OperationDuration = metrics.NewHistogram(
+		"runner_store_operation_duration_seconds",
+		"Latency of data store operations.",
+		[]float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		"backend", "operation",
+	)
+	// OperationErrors counts failed data store operations by backend and operation.
+	OperationErrors = metrics.NewCounter(
+		"runner_store_operation_errors_total",
+		"Number of failed data store operations.",
+		"backend", "operation",
+	)
+)
@@ -0,0 +1,303 @@
+package store
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/tracing"
+)
+
+// Operation describes data store operation passing through middlewares.
+type Operation struct {
+	// Name is operation's name, e.g. "get" or "commit".
+	Name string
+	// ID is id of the record operation is about, if any. Claim sets it once the record is claimed.
+	ID string
+	// Args are key-value pairs describing operation, e.g. number of found records; they are complete
+	// once next middleware returns.
+	Args []interface{}
+}
+
+// Middleware intercepts data store operations, it calls next to proceed with the operation, possibly with
+// modified context. Cross-cutting behaviour, e.g. logging or retries, is implemented by middlewares, so that
+// backends contain storage logic only.
+type Middleware func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error
+
+// Use wraps data store so that its operations pass through middlewares, the first one is the outermost.
+// Writes batched by Begin pass through them on commit; Watch passes through them once it's started.
+// Data store which implements Claimer is returned as one.
+func Use(s Service, mws ...Middleware) Service {
+	if len(mws) == 0 {
+		return s
+	}
+	c := &chain{Service: s, mws: mws}
+	if cl, ok := s.(Claimer); ok {
+		return &claimingChain{c, cl}
+	}
+	return c
+}
+
+// Instrument wraps data store with middlewares shared by all backends: tracing, metrics and logging.
+func Instrument(s Service, backend string, logger logging.Logger, mws ...Middleware) Service {
+	return Use(s, append([]Middleware{Tracing(backend), Metrics(backend), Logging(logger)}, mws...)...)
+}
+
+// Tracing records data store operations as tracing spans.
+func Tracing(backend string) Middleware {
+	return func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		ctx, span := tracing.Start(ctx, "store."+op.Name, "store.backend", backend, "store.operation", op.Name)
+		err := next(ctx)
+		if op.ID != "" {
+			span.SetAttribute("store.id", op.ID)
+		}
+		span.End(err)
+		return err
+	}
+}
+
+// Metrics observes latency and failures of data store operations.
+func Metrics(backend string) Middleware {
+	return func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		t0 := time.Now()
+		err := next(ctx)
+		OperationDuration.With(backend, op.Name).Observe(time.Since(t0).Seconds())
+		if err != nil {
+			OperationErrors.With(backend, op.Name).Inc()
+		}
+		return err
+	}
+}
+
+// Logging logs data store operations: failures as errors, successful operations for debugging.
+func Logging(logger logging.Logger) Middleware {
+	return func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		t0 := time.Now()
+		err := next(ctx)
+
+		args := append(append([]interface{}(nil), op.Args...), "operation", op.Name, "duration_ms", logging.DurationMs(time.Since(t0)))
+		if op.ID != "" {
+			args = append(args, "id", op.ID)
+		}
+		switch {
+		case err == ErrConflict:
+			// Conflicts are expected with concurrent writers, callers resolve them
+			logger.Debug("store operation conflicted", args...)
+		case err != nil:
+			logger.Error("store operation failed", append(args, "error", err.Error())...)
+		default:
+			logger.Debug("store operation", args...)
+		}
+		return err
+	}
+}
+
+// Retry retries operations failing with errors transient reports, e.g. lost database connection, up to
+// provided number of attempts. Delay between attempts starts at backoff and doubles; operation is not retried
+// if context is cancelled, or its deadline would pass by the time of the next attempt. Operations are retried
+// as a whole, so that writes failed half way are not applied.
+func Retry(attempts int, backoff time.Duration, transient func(err error) bool) Middleware {
+	return func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		delay := backoff
+		for i := 1; ; i++ {
+			err := next(ctx)
+			if err == nil || i >= attempts || !transient(err) {
+				return err
+			}
+
+			// Jitter spreads retries of clients which failed at the same time
+			wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+				return err
+			}
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			case <-t.C:
+			}
+			delay *= 2
+		}
+	}
+}
+
+// RateLimit limits data store operations to provided rate per second, allowing bursts of provided size.
+// Operations wait for their turn unless context is cancelled.
+func RateLimit(rate float64, burst int) Middleware {
+	l := &limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+	return func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		if err := l.wait(ctx); err != nil {
+			return err
+		}
+		return next(ctx)
+	}
+}
+
+// limiter is a token bucket.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// wait takes a token, waiting for it if the bucket is empty.
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// Token is taken in advance, the bucket goes negative while operations wait
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// chain passes operations of data store through middlewares.
+type chain struct {
+	Service
+	mws []Middleware
+}
+
+// run passes operation through middlewares, fn performs it.
+func (c *chain) run(ctx context.Context, op *Operation, fn func(ctx context.Context) error) error {
+	var next func(i int) func(ctx context.Context) error
+	next = func(i int) func(ctx context.Context) error {
+		if i == len(c.mws) {
+			return fn
+		}
+		return func(ctx context.Context) error {
+			return c.mws[i](ctx, op, next(i+1))
+		}
+	}
+	return next(0)(ctx)
+}
+
+func (c *chain) Create(ctx context.Context, rec Record) error {
+	return c.run(ctx, &Operation{Name: "create", ID: rec.ID()}, func(ctx context.Context) error {
+		return c.Service.Create(ctx, rec)
+	})
+}
+
+func (c *chain) Update(ctx context.Context, id string, rec Record) error {
+	return c.run(ctx, &Operation{Name: "update", ID: id, Args: []interface{}{"success", rec.Success()}}, func(ctx context.Context) error {
+		return c.Service.Update(ctx, id, rec)
+	})
+}
+
+func (c *chain) Delete(ctx context.Context, id string) error {
+	return c.run(ctx, &Operation{Name: "delete", ID: id}, func(ctx context.Context) error {
+		return c.Service.Delete(ctx, id)
+	})
+}
+
+func (c *chain) Get(ctx context.Context, id string) (rec Record, err error) {
+	err = c.run(ctx, &Operation{Name: "get", ID: id}, func(ctx context.Context) (err error) {
+		rec, err = c.Service.Get(ctx, id)
+		return
+	})
+	return
+}
+
+func (c *chain) GetAll(ctx context.Context) (recs []Record, err error) {
+	err = c.run(ctx, &Operation{Name: "get-all"}, func(ctx context.Context) (err error) {
+		recs, err = c.Service.GetAll(ctx)
+		return
+	})
+	return
+}
+
+func (c *chain) Find(ctx context.Context, q Query) (page Page, err error) {
+	op := &Operation{Name: "find"}
+	err = c.run(ctx, op, func(ctx context.Context) (err error) {
+		page, err = c.Service.Find(ctx, q)
+		op.Args = []interface{}{"records", len(page.Records)}
+		return
+	})
+	return
+}
+
+func (c *chain) Watch(ctx context.Context, f Filter) (ch <-chan Event, err error) {
+	err = c.run(ctx, &Operation{Name: "watch", Args: []interface{}{"revision", f.Revision}}, func(_ context.Context) (err error) {
+		// Watch outlives the operation, it keeps caller's context
+		ch, err = c.Service.Watch(ctx, f)
+		return
+	})
+	return
+}
+
+func (c *chain) Compact(ctx context.Context) error {
+	return c.run(ctx, &Operation{Name: "compact"}, func(ctx context.Context) error {
+		return c.Service.Compact(ctx)
+	})
+}
+
+func (c *chain) Close() error {
+	return c.run(context.Background(), &Operation{Name: "close"}, func(_ context.Context) error {
+		return c.Service.Close()
+	})
+}
+
+// Begin starts a batch of writes, which passes through middlewares on commit. Every attempt to commit it
+// applies the writes in a new batch of wrapped data store, so that failed commit can be retried.
+func (c *chain) Begin(ctx context.Context) (Tx, error) {
+	return NewTx(func(ops []Op) error {
+		return c.run(ctx, &Operation{Name: "commit", Args: []interface{}{"ops", len(ops)}}, func(ctx context.Context) error {
+			tx, err := c.Service.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			for _, op := range ops {
+				switch op.Type {
+				case EventCreate:
+					tx.Create(op.Record)
+				case EventUpdate:
+					tx.Update(op.Record)
+				case EventDelete:
+					tx.Delete(op.ID)
+				}
+			}
+			return tx.Commit()
+		})
+	}), nil
+}
+
+// claimingChain is a chain of data store which implements Claimer.
+type claimingChain struct {
+	*chain
+	claimer Claimer
+}
+
+func (c *claimingChain) Claim(ctx context.Context, q Query, fn func(rec Record) Record) (claimed Record, err error) {
+	op := &Operation{Name: "claim", Args: []interface{}{"kind", q.Kind}}
+	err = c.run(ctx, op, func(ctx context.Context) (err error) {
+		claimed, err = c.claimer.Claim(ctx, q, fn)
+		if claimed != nil {
+			op.ID = claimed.ID()
+		}
+		return
+	})
+	return
+}
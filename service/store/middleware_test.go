@@ -0,0 +1,162 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/memory"
+)
+
+// recorder returns middleware which logs operations passing through it.
+func recorder(name string, log *[]string) store.Middleware {
+	return func(ctx context.Context, op *store.Operation, next func(ctx context.Context) error) error {
+		*log = append(*log, name+">"+op.Name)
+		err := next(ctx)
+		*log = append(*log, name+"<"+op.Name)
+		return err
+	}
+}
+
+// flaky returns middleware failing the first n attempts of every operation with provided error.
+func flaky(n int, err error, attempts *int) store.Middleware {
+	return func(ctx context.Context, op *store.Operation, next func(ctx context.Context) error) error {
+		if *attempts++; *attempts <= n {
+			return err
+		}
+		return next(ctx)
+	}
+}
+
+var errTransient = errors.New("connection reset")
+
+func isTransient(err error) bool {
+	return err == errTransient
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		call func(s store.Service) error
+	}{
+		{"create", func(s store.Service) error { return s.Create(ctx, job("b", "", 0)) }},
+		{"update", func(s store.Service) error { return s.Update(ctx, "a", get(t, s, "a")) }},
+		{"get", func(s store.Service) error { _, err := s.Get(ctx, "a"); return err }},
+		{"get-all", func(s store.Service) error { _, err := s.GetAll(ctx); return err }},
+		{"find", func(s store.Service) error { _, err := s.Find(ctx, store.Query{}); return err }},
+		{"watch", func(s store.Service) error { _, err := s.Watch(ctx, store.Filter{}); return err }},
+		{"delete", func(s store.Service) error { return s.Delete(ctx, "a") }},
+		{"compact", func(s store.Service) error { return s.Compact(ctx) }},
+		{"close", func(s store.Service) error { return s.Close() }},
+		{"commit", func(s store.Service) error {
+			tx, err := s.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			tx.Create(job("b", "", 0))
+			tx.Delete("a")
+			return tx.Commit()
+		}},
+	}
+	for _, tt := range tests {
+		backing := memory.New(memory.WithLogger(logging.Discard()))
+		if err := backing.Create(ctx, job("a", "", 0)); err != nil {
+			t.Fatal(err)
+		}
+		var log []string
+		s := store.Use(backing, recorder("outer", &log), recorder("inner", &log))
+		if err := tt.call(s); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+
+		// Update reads the record first
+		if tt.name == "update" {
+			log = log[4:]
+		}
+		want := []string{"outer>" + tt.name, "inner>" + tt.name, "inner<" + tt.name, "outer<" + tt.name}
+		if !reflect.DeepEqual(log, want) {
+			t.Errorf("%v passed through %v, want %v", tt.name, log, want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		attempts int
+		want     error
+	}{
+		{"succeeds", 0, errTransient, 1, nil},
+		{"recovers", 2, errTransient, 3, nil},
+		{"gives up", 5, errTransient, 3, errTransient},
+		{"permanent failure", 5, store.ErrConflict, 1, store.ErrConflict},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		s := store.Use(memory.New(memory.WithLogger(logging.Discard())),
+			store.Retry(3, time.Millisecond, isTransient), flaky(tt.failures, tt.err, &attempts))
+		err := s.Create(context.Background(), job("a", "", 0))
+		if err != tt.want || attempts != tt.attempts {
+			t.Errorf("%v: Create() = %v after %d attempts, want %v after %d", tt.name, err, attempts, tt.want, tt.attempts)
+		}
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Next attempt would start after the deadline
+	short, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, ctx := range []context.Context{cancelled, short} {
+		attempts := 0
+		s := store.Use(memory.New(memory.WithLogger(logging.Discard())),
+			store.Retry(3, time.Hour, isTransient), flaky(5, errTransient, &attempts))
+		t0 := time.Now()
+		if err := s.Create(ctx, job("a", "", 0)); err != errTransient || attempts != 1 {
+			t.Errorf("Create() = %v after %d attempts, want %v after 1", err, attempts, errTransient)
+		}
+		if d := time.Since(t0); d > 100*time.Millisecond {
+			t.Errorf("Create() gave up after %v", d)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	s := store.Use(memory.New(memory.WithLogger(logging.Discard())), store.RateLimit(100, 2))
+
+	// Burst passes right away, the rest waits for the rate
+	t0 := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := s.GetAll(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(t0); d > 5*time.Millisecond {
+		t.Errorf("burst took %v", d)
+	}
+	t0 = time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetAll(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(t0); d < 25*time.Millisecond {
+		t.Errorf("3 operations over burst took %v, want at least 30ms", d)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	if _, err := s.GetAll(cctx); err != context.DeadlineExceeded {
+		t.Errorf("GetAll() with empty bucket = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
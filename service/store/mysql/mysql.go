@@ -0,0 +1,100 @@
+package mysql
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/sqlstore"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+
+	// installing mysql driver for gorm module
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+)
+
+// Exported errors.
+var (
+	// ErrNotFound error is returned when object is not found in the data store.
+	ErrNotFound = sqlstore.ErrNotFound
+	// ErrAlreadyExists error is returned when object with the same id is already in the data store.
+	ErrAlreadyExists = sqlstore.ErrAlreadyExists
+)
+
+// DefaultDSN is data source name of local test database.
+const DefaultDSN = "root@/test?charset=utf8&parseTime=True&loc=Local"
+
+// Dialect describes MySQL to SQL data store.
+var Dialect = sqlstore.Dialect{
+	Name:        "mysql",
+	IsDuplicate: isDuplicate,
+	IsTransient: isTransient,
+	// SKIP LOCKED needs MySQL 8, older servers make concurrent claims wait instead
+	Lock: "FOR UPDATE",
+}
+
+// defaults are connection parameters used unless URL sets them.
+var defaults = map[string]string{
+	"charset":   "utf8",
+	"parseTime": "True",
+	"loc":       "Local",
+}
+
+func init() {
+	store.Register("mysql", open)
+}
+
+// open opens data store described by URL, e.g. "mysql://runner:secret@db:3306/runner?poll=1s". Parameters not
+// known to data store are passed to the driver.
+func open(u *url.URL, logger logging.Logger) (store.Service, error) {
+	p := store.NewParams(u)
+	opts := sqlstore.Params(p, logger)
+	if err := p.Err(); err != nil {
+		return nil, err
+	}
+	for k, v := range defaults {
+		if _, ok := p.Values[k]; !ok {
+			p.Set(k, v)
+		}
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "3306")
+	}
+	user := u.User.Username()
+	if pass, ok := u.User.Password(); ok {
+		user += ":" + pass
+	}
+	return New(fmt.Sprintf("%v@tcp(%v)%v?%v", user, addr, u.Path, p.Encode()), opts...)
+}
+
+// New creates new MySQL based data store service. Data source name must enable parseTime.
+func New(dsn string, opts ...sqlstore.Option) (store.Service, error) {
+	db, err := gorm.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return sqlstore.New(db, Dialect, opts...)
+}
+
+// transientErrors are numbers of MySQL errors which may not happen again: too many connections, server
+// shutdown, lock wait timeout and deadlock.
+var transientErrors = map[uint16]bool{1040: true, 1053: true, 1205: true, 1213: true}
+
+// isTransient reports whether err is MySQL's transient failure.
+func isTransient(err error) bool {
+	if err == mysql.ErrInvalidConn {
+		return true
+	}
+	merr, ok := err.(*mysql.MySQLError)
+	return ok && transientErrors[merr.Number]
+}
+
+// isDuplicate reports whether err is MySQL's duplicate key error.
+func isDuplicate(err error) bool {
+	merr, ok := err.(*mysql.MySQLError)
+	return ok && merr.Number == 1062
+}
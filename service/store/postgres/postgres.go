@@ -0,0 +1,144 @@
+package postgres
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/sqlstore"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+
+	// installing postgres driver for gorm module
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// Exported errors.
+var (
+	// ErrNotFound error is returned when object is not found in the data store.
+	ErrNotFound = sqlstore.ErrNotFound
+	// ErrAlreadyExists error is returned when object with the same id is already in the data store.
+	ErrAlreadyExists = sqlstore.ErrAlreadyExists
+)
+
+// Channel is name of the channel changes are announced on.
+const Channel = "runner_changes"
+
+// Listener reconnection backoff.
+const (
+	minReconnect = time.Second
+	maxReconnect = time.Minute
+)
+
+func init() {
+	store.Register("postgres", open)
+	store.Register("postgresql", open)
+}
+
+// open opens data store described by URL, e.g. "postgres://runner@db/runner?sslmode=disable&poll=5s".
+// Parameters not known to data store are passed to the driver.
+func open(u *url.URL, logger logging.Logger) (store.Service, error) {
+	p := store.NewParams(u)
+	opts := sqlstore.Params(p, logger)
+	if err := p.Err(); err != nil {
+		return nil, err
+	}
+	dsn := *u
+	dsn.RawQuery = p.Encode()
+	return New(dsn.String(), opts...)
+}
+
+// New creates new PostgreSQL based data store service. Data source name is either URL or key=value pairs,
+// e.g. "postgres://runner@localhost/runner?sslmode=disable". Watchers are woken up by notifications of
+// changes, claimed rows locked by concurrent transactions are skipped.
+func New(dsn string, opts ...sqlstore.Option) (store.Service, error) {
+	db, err := gorm.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	n := newNotifier(dsn)
+	if err := n.listener.Listen(Channel); err != nil {
+		_ = n.listener.Close()
+		_ = db.Close()
+		return nil, err
+	}
+	go n.run()
+
+	s, err := sqlstore.New(db, sqlstore.Dialect{
+		Name:        "postgres",
+		IsDuplicate: isDuplicate,
+		IsTransient: isTransient,
+		Lock:        "FOR UPDATE SKIP LOCKED",
+		Notify:      notify,
+		Changed:     n.changed,
+		Close:       n.listener.Close,
+	}, opts...)
+	if err != nil {
+		_ = n.listener.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// notify announces changes made in transaction, notification is delivered once transaction commits.
+func notify(tx *gorm.DB) error {
+	return tx.Exec("NOTIFY " + Channel).Error
+}
+
+// notifier wakes up watchers when changes are announced.
+type notifier struct {
+	listener *pq.Listener
+
+	mu sync.Mutex
+	// ch is closed and replaced on every notification
+	ch chan struct{}
+}
+
+// newNotifier creates notifier with its own connection, which is reestablished when lost. Watchers keep
+// polling while it is down.
+func newNotifier(dsn string) *notifier {
+	return &notifier{
+		listener: pq.NewListener(dsn, minReconnect, maxReconnect, nil),
+		ch:       make(chan struct{}),
+	}
+}
+
+// run dispatches notifications, nil one follows reconnection and means some of them might have been missed.
+func (n *notifier) run() {
+	for range n.listener.Notify {
+		n.mu.Lock()
+		close(n.ch)
+		n.ch = make(chan struct{})
+		n.mu.Unlock()
+	}
+}
+
+// changed returns channel closed on the next notification.
+func (n *notifier) changed() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+// isTransient reports whether err is PostgreSQL's transient failure: connection exception, serialization
+// failure, deadlock, server shutdown or too many connections.
+func isTransient(err error) bool {
+	perr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch perr.Code {
+	case "40001", "40P01", "57P01", "57P02", "57P03", "53300":
+		return true
+	}
+	return perr.Code.Class() == "08"
+}
+
+// isDuplicate reports whether err is PostgreSQL's unique violation.
+func isDuplicate(err error) bool {
+	perr, ok := err.(*pq.Error)
+	return ok && perr.Code == "23505"
+}
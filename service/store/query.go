@@ -0,0 +1,133 @@
+package store
+
+import (
+	"time"
+
+	"github.com/caelifer/runner/component"
+)
+
+// DefaultLimit is page size used by queries which do not set their own.
+const DefaultLimit = 100
+
+// Query selects records. Zero fields do not restrict the result, records are ordered by id,
+// that is by creation time.
+type Query struct {
+	// Kind is kind record's type is registered under, e.g. "job" or "task".
+	Kind string
+	// ID matches the record with this id.
+	ID string
+	// Status matches records in any of listed statuses.
+	Status []component.Status
+	// JobID matches tasks of the job.
+	JobID string
+	Name  string
+	// Since and Until limit record's creation time to [Since, Until).
+	Since time.Time
+	Until time.Time
+	// Labels must all be present in task's spec.
+	Labels map[string]string
+	// Owner matches records claimed by the owner, e.g. leased by the worker.
+	Owner string
+	// Free matches records which are not claimed or whose claim expired by this time.
+	Free time.Time
+	// Cursor continues listing after the record with this id, it is taken from Page.Next.
+	Cursor string
+	// Limit is maximal number of returned records, DefaultLimit if not set.
+	Limit int
+}
+
+// Page is a part of query's result.
+type Page struct {
+	Records []Record
+	// Next is a cursor of the next page, it is empty if there are no more records.
+	Next string
+	// Revision is data store's revision page was read at, changes made later are delivered by watch
+	// resumed from it.
+	Revision int64
+}
+
+// PageSize returns number of records query returns at most.
+func (q Query) PageSize() int {
+	if q.Limit <= 0 {
+		return DefaultLimit
+	}
+	return q.Limit
+}
+
+// Match reports whether record matches query, cursor and limit are not considered.
+func (q Query) Match(rec Record) bool {
+	s := Summarize(rec)
+	if q.Kind != "" && s.Kind != q.Kind {
+		return false
+	}
+	if q.ID != "" && rec.ID() != q.ID {
+		return false
+	}
+	if len(q.Status) > 0 {
+		found := false
+		for _, st := range q.Status {
+			found = found || st == s.Status
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.JobID != "" && s.JobID != q.JobID {
+		return false
+	}
+	if q.Name != "" && s.Name != q.Name {
+		return false
+	}
+	if !q.Since.IsZero() && s.Created.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !s.Created.Before(q.Until) {
+		return false
+	}
+	for k, v := range q.Labels {
+		if lv, ok := s.Labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	if q.Owner != "" && s.Owner != q.Owner {
+		return false
+	}
+	if !q.Free.IsZero() && s.Owner != "" && !s.Expires.Before(q.Free) {
+		return false
+	}
+	return true
+}
+
+// Summary is a part of record's state queries are matched against, backends may index it.
+type Summary struct {
+	Kind    string
+	JobID   string
+	Name    string
+	Status  component.Status
+	Created time.Time
+	Labels  map[string]string
+	// Owner claimed the record until it Expires, e.g. worker leased queued item.
+	Owner   string
+	Expires time.Time
+}
+
+// Summarizer is implemented by records defined outside of this package, they describe their queryable state.
+type Summarizer interface {
+	Summary() Summary
+}
+
+// Summarize extracts queryable state of the record.
+func Summarize(rec Record) Summary {
+	var s Summary
+	switch rec := rec.(type) {
+	case Summarizer:
+		s = rec.Summary()
+	case *JobRecord:
+		s.Name, s.Status, s.Created = rec.Name, rec.Status, rec.CreatedAt
+	case *TaskRecord:
+		s.JobID, s.Name, s.Status, s.Created = rec.JobID, rec.Name, rec.Status, rec.CreatedAt
+		s.Labels = rec.Spec.Labels
+	}
+	s.Kind, _ = KindOf(rec)
+	return s
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"time"
+
+	"github.com/caelifer/runner/component"
+)
+
+// Meta is execution state common to jobs and tasks.
+type Meta struct {
+	Status component.Status `json:"status"`
+	// History lists every status change with its time.
+	History    []component.Transition `json:"history,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	StartedAt  time.Time              `json:"started_at,omitempty"`
+	FinishedAt time.Time              `json:"finished_at,omitempty"`
+	// Attempts is number of times execution was started.
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	// SpecHash identifies spec the job or task was created from.
+	SpecHash string `json:"spec_hash"`
+	Version
+}
+
+// JobRecord is a persistent state of a job.
+type JobRecord struct {
+	JobID      string            `json:"id"`
+	Name       string            `json:"name"`
+	ScheduleID string            `json:"schedule_id,omitempty"`
+	Tenant     string            `json:"tenant,omitempty"`
+	Priority   int               `json:"priority,omitempty"`
+	TaskIDs    []string          `json:"task_ids,omitempty"`
+	Spec       component.JobSpec `json:"spec"`
+	Meta
+}
+
+// ID returns job's id, it implements Record interface.
+func (r *JobRecord) ID() string {
+	return r.JobID
+}
+
+// Success reports whether job succeeded, it implements Record interface.
+func (r *JobRecord) Success() bool {
+	return r.Status == component.StatusSucceeded
+}
+
+// TaskRecord is a persistent state of a task.
+type TaskRecord struct {
+	TaskID string             `json:"id"`
+	JobID  string             `json:"job_id,omitempty"`
+	Name   string             `json:"name"`
+	Spec   component.TaskSpec `json:"spec"`
+	// Worker is id of the node task was assigned to, it is empty for tasks executed by job's process.
+	Worker string `json:"worker,omitempty"`
+	// ExitCode is exit code of task's command, -1 if command did not exit on its own.
+	ExitCode int `json:"exit_code"`
+	Meta
+}
+
+// ID returns task's id, it implements Record interface.
+func (r *TaskRecord) ID() string {
+	return r.TaskID
+}
+
+// Success reports whether task succeeded, it implements Record interface.
+func (r *TaskRecord) Success() bool {
+	return r.Status == component.StatusSucceeded
+}
+
+func init() {
+	RegisterKind("job", &JobRecord{})
+	RegisterKind("task", &TaskRecord{})
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+)
+
+// Opener opens data store described by URL. Options are passed as URL's query parameters.
+type Opener func(u *url.URL, logger logging.Logger) (Service, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = make(map[string]Opener)
+)
+
+// Register makes data store backend available under URL scheme. Backends register themselves in their init
+// functions, so that importing backend's package is enough to use it. It panics if scheme is already registered.
+func Register(scheme string, open Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	if _, ok := openers[scheme]; ok {
+		panic(fmt.Sprintf("store: scheme %q is already registered", scheme))
+	}
+	openers[scheme] = open
+}
+
+// Schemes returns registered URL schemes in alphabetical order.
+func Schemes() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+	schemes := make([]string, 0, len(openers))
+	for s := range openers {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open opens data store described by URL, e.g. "memory://" or "file:///var/lib/runner?fsync=interval".
+func Open(rawurl string, logger logging.Logger) (Service, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("store: %v", err)
+	}
+
+	openersMu.RLock()
+	open, ok := openers[u.Scheme]
+	openersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("store: unknown scheme %q, registered are %v", u.Scheme, strings.Join(Schemes(), ", "))
+	}
+
+	s, err := open(u, logger)
+	if err != nil {
+		return nil, fmt.Errorf("store: opening %v: %v", Redact(u), err)
+	}
+	return s, nil
+}
+
+// Redact returns URL with password masked, so that it can be logged.
+func Redact(u *url.URL) string {
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+	c := *u
+	c.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return c.String()
+}
+
+// Path returns location URL points to, both host and path of "file://data/runner" make it up, as well as
+// opaque part of "sqlite::memory:".
+func Path(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+// Params consumes query parameters of data store's URL. Parameters are removed once parsed, so that remaining
+// ones can be passed to database driver or reported as unknown.
+type Params struct {
+	url.Values
+	err error
+}
+
+// NewParams returns parameters of the URL.
+func NewParams(u *url.URL) *Params {
+	return &Params{Values: u.Query()}
+}
+
+// String consumes string parameter, def is returned if it is missing.
+func (p *Params) String(name, def string) string {
+	if _, ok := p.Values[name]; !ok {
+		return def
+	}
+	v := p.Get(name)
+	p.Del(name)
+	return v
+}
+
+// Int consumes integer parameter, def is returned if it is missing.
+func (p *Params) Int(name string, def int) int {
+	v := p.String(name, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		p.fail(name, v)
+		return def
+	}
+	return n
+}
+
+// Duration consumes duration parameter, e.g. "500ms"; def is returned if it is missing.
+func (p *Params) Duration(name string, def time.Duration) time.Duration {
+	v := p.String(name, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		p.fail(name, v)
+		return def
+	}
+	return d
+}
+
+// Err returns the first parsing error.
+func (p *Params) Err() error {
+	return p.err
+}
+
+// Done returns the first parsing error, or error naming parameters which were not consumed.
+func (p *Params) Done() error {
+	if p.err != nil || len(p.Values) == 0 {
+		return p.err
+	}
+	var names []string
+	for name := range p.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown parameters %v", strings.Join(names, ", "))
+}
+
+func (p *Params) fail(name, value string) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid %v parameter %q", name, value)
+	}
+}
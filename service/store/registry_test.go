@@ -0,0 +1,127 @@
+package store_test
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	_ "github.com/caelifer/runner/service/store/file"
+	_ "github.com/caelifer/runner/service/store/memory"
+	_ "github.com/caelifer/runner/service/store/sqlite"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		url string
+		// err is a part of expected error message, empty if data store opens
+		err string
+	}{
+		{"memory://", ""},
+		{"memory://?history=10", ""},
+		{"memory://?history=ten", `invalid history parameter "ten"`},
+		{"memory://?histroy=10", "unknown parameters histroy"},
+		{"file://" + filepath.Join(dir, "file") + "?fsync=interval&sync_interval=10ms", ""},
+		{"file://", "data directory is required"},
+		{"file://" + dir + "?fsync=never", `invalid fsync parameter "never"`},
+		{"sqlite::memory:", ""},
+		{"sqlite://" + filepath.Join(dir, "runner.db") + "?poll=10ms&_busy_timeout=100", ""},
+		{"sqlite://" + filepath.Join(dir, "runner.db") + "?poll=soon", `invalid poll parameter "soon"`},
+		{"nosql://host/db", `unknown scheme "nosql"`},
+		{"%zz", "invalid URL escape"},
+	}
+	for _, tt := range tests {
+		s, err := store.Open(tt.url, logging.Discard())
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("Open(%q) failed: %v", tt.url, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("Open(%q) = %v, want error containing %q", tt.url, err, tt.err)
+		case tt.err == "" && s == nil:
+			t.Errorf("Open(%q) returned no data store", tt.url)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	open := func(*url.URL, logging.Logger) (store.Service, error) { return nil, nil }
+	store.Register("registry-test", open)
+
+	found := false
+	for _, s := range store.Schemes() {
+		found = found || s == "registry-test"
+	}
+	if !found {
+		t.Errorf("Schemes() = %v, want registry-test among them", store.Schemes())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering scheme twice did not panic")
+		}
+	}()
+	store.Register("registry-test", open)
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		url    string
+		path   string
+		redact string
+	}{
+		{"file://data/runner", "data/runner", "file://data/runner"},
+		{"file:///var/lib/runner", "/var/lib/runner", "file:///var/lib/runner"},
+		{"sqlite::memory:", ":memory:", "sqlite::memory:"},
+		{"mysql://user:secret@db:3306/runner", "db:3306/runner", "mysql://user:xxxxx@db:3306/runner"},
+		{"postgres://user@db/runner", "db/runner", "postgres://user@db/runner"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := store.Path(u); got != tt.path {
+			t.Errorf("Path(%q) = %q, want %q", tt.url, got, tt.path)
+		}
+		if got := store.Redact(u); got != tt.redact {
+			t.Errorf("Redact(%q) = %q, want %q", tt.url, got, tt.redact)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	u, err := url.Parse("memory://?name=x&n=3&d=2s&bad=1x&extra=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := store.NewParams(u)
+	if got := p.String("name", "def"); got != "x" {
+		t.Errorf("String(name) = %q, want x", got)
+	}
+	if got := p.String("missing", "def"); got != "def" {
+		t.Errorf("String(missing) = %q, want def", got)
+	}
+	if got := p.Int("n", 0); got != 3 {
+		t.Errorf("Int(n) = %d, want 3", got)
+	}
+	if got := p.Duration("d", 0); got != 2*time.Second {
+		t.Errorf("Duration(d) = %v, want 2s", got)
+	}
+	if p.Err() != nil {
+		t.Fatalf("Err() = %v", p.Err())
+	}
+	if err := p.Done(); err == nil || err.Error() != "unknown parameters bad, extra" {
+		t.Errorf("Done() = %v, want unknown bad and extra", err)
+	}
+
+	if got := p.Int("bad", 7); got != 7 {
+		t.Errorf("Int(bad) = %d, want default 7", got)
+	}
+	if err := p.Done(); err == nil || err.Error() != `invalid bad parameter "1x"` {
+		t.Errorf("Done() = %v, want invalid bad parameter", err)
+	}
+}
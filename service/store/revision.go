@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// Exported errors.
+var (
+	// ErrConflict error is returned by Update when record's revision does not match the stored one,
+	// that is when record was changed by someone else since it was read.
+	ErrConflict = errors.New("revision conflict")
+)
+
+// Version carries record's revision, it is meant to be embedded into record types.
+type Version struct {
+	Rev int64 `json:"revision"`
+}
+
+// Revision returns revision of record's stored state, it implements Record interface.
+func (v *Version) Revision() int64 {
+	return v.Rev
+}
+
+// SetRevision sets record's revision, it implements Record interface.
+func (v *Version) SetRevision(rev int64) {
+	v.Rev = rev
+}
+
+// maxConflicts is number of conflicts Save resolves before it gives up.
+const maxConflicts = 5
+
+// Save updates record, resolving conflicts with concurrent changes. On conflict resolve is called with
+// the stored state and returns record to write instead, or nil to keep the stored state.
+func Save(ctx context.Context, s Service, rec Record, resolve func(stored Record) Record) error {
+	for i := 0; ; i++ {
+		err := s.Update(ctx, rec.ID(), rec)
+		if err != ErrConflict || i == maxConflicts {
+			return err
+		}
+
+		stored, err := s.Get(ctx, rec.ID())
+		if err != nil {
+			return err
+		}
+		if rec = resolve(stored); rec == nil {
+			return nil
+		}
+	}
+}
+
+// KeepNewer returns conflict resolver which writes rec with stored revision, unless stored state of job
+// or task has progressed further. Lifecycle history only grows, so the longer history is the newer one.
+func KeepNewer(rec Record) func(stored Record) Record {
+	return func(stored Record) Record {
+		if history(stored) > history(rec) {
+			return nil
+		}
+		rec.SetRevision(stored.Revision())
+		return rec
+	}
+}
+
+func history(rec Record) int {
+	switch rec := rec.(type) {
+	case *JobRecord:
+		return len(rec.History)
+	case *TaskRecord:
+		return len(rec.History)
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+package sqlite
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/caelifer/runner/service/store/sqlstore"
+	"github.com/jinzhu/gorm"
+	"github.com/mattn/go-sqlite3"
+
+	// installing sqlite driver for gorm module
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// Exported errors.
+var (
+	// ErrNotFound error is returned when object is not found in the data store.
+	ErrNotFound = sqlstore.ErrNotFound
+	// ErrAlreadyExists error is returned when object with the same id is already in the data store.
+	ErrAlreadyExists = sqlstore.ErrAlreadyExists
+)
+
+// Memory is path of database kept in memory, it is lost when data store is closed.
+const Memory = ":memory:"
+
+// Dialect describes SQLite to SQL data store.
+var Dialect = sqlstore.Dialect{
+	Name:        "sqlite",
+	IsDuplicate: isDuplicate,
+	IsTransient: isTransient,
+}
+
+// defaults are connection parameters used unless path sets them.
+var defaults = map[string]string{
+	// Wait for other processes sharing the file instead of failing right away
+	"_busy_timeout": "5000",
+	"_journal_mode": "WAL",
+}
+
+func init() {
+	store.Register("sqlite", open)
+}
+
+// open opens data store described by URL, e.g. "sqlite:///var/lib/runner.db?poll=1s" or "sqlite::memory:".
+// Parameters not known to data store are passed to the driver.
+func open(u *url.URL, logger logging.Logger) (store.Service, error) {
+	p := store.NewParams(u)
+	opts := sqlstore.Params(p, logger)
+	if err := p.Err(); err != nil {
+		return nil, err
+	}
+	path := store.Path(u)
+	if len(p.Values) > 0 {
+		path += "?" + p.Encode()
+	}
+	return New(path, opts...)
+}
+
+// New creates new SQLite based data store service persisted in database file at provided path, which may
+// carry driver's connection parameters, e.g. "runner.db?_busy_timeout=1000". Database is created if it does
+// not exist.
+func New(path string, opts ...sqlstore.Option) (store.Service, error) {
+	query := url.Values{}
+	if i := strings.Index(path, "?"); i >= 0 {
+		var err error
+		if query, err = url.ParseQuery(path[i+1:]); err != nil {
+			return nil, err
+		}
+		path = path[:i]
+	}
+	for k, v := range defaults {
+		if _, ok := query[k]; !ok {
+			query.Set(k, v)
+		}
+	}
+
+	db, err := gorm.Open("sqlite3", path+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has single writer, serializing connections avoids failing on locked database; it also
+	// makes in-memory database shared by all queries
+	db.DB().SetMaxOpenConns(1)
+
+	return sqlstore.New(db, Dialect, opts...)
+}
+
+// isTransient reports whether err is SQLite's failure to lock database still locked once busy timeout passed.
+func isTransient(err error) bool {
+	serr, ok := err.(sqlite3.Error)
+	return ok && (serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked)
+}
+
+// isDuplicate reports whether err is SQLite's unique constraint violation.
+func isDuplicate(err error) bool {
+	serr, ok := err.(sqlite3.Error)
+	return ok && (serr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || serr.ExtendedCode == sqlite3.ErrConstraintUnique)
+}
@@ -0,0 +1,62 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/caelifer/runner/service/store"
+	"github.com/jinzhu/gorm"
+)
+
+// Retry defaults, operations failing transiently are retried for a few seconds before they fail.
+const (
+	DefaultRetryAttempts = 5
+	DefaultRetryBackoff  = 200 * time.Millisecond
+)
+
+// classify wraps database errors into store.Error, so that callers can tell transient failures from permanent
+// ones. Errors describing state of records, e.g. store.ErrNotFound, are returned as they are.
+func (ss *sqlstore) classify(ctx context.Context, op *store.Operation, next func(ctx context.Context) error) error {
+	err := next(ctx)
+	switch err {
+	case nil, store.ErrNotFound, store.ErrAlreadyExists, store.ErrConflict, store.ErrCompacted, context.Canceled, context.DeadlineExceeded:
+		return err
+	}
+	if _, ok := err.(*store.Error); ok {
+		return err
+	}
+
+	e := &store.Error{Backend: ss.dialect.Name, Transient: ss.isTransient(err), Err: err}
+	if e.Transient {
+		ss.logger.Warn("store database failed transiently", "operation", op.Name, "error", err.Error())
+	}
+	return e
+}
+
+// isTransient reports whether err is database failure which may not happen again, e.g. lost connection.
+func (ss *sqlstore) isTransient(err error) bool {
+	// Gorm collects errors of callbacks, failure is transient if any of them is
+	if errs, ok := err.(gorm.Errors); ok {
+		for _, err := range errs {
+			if ss.isTransient(err) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var nerr net.Error
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &nerr):
+		return true
+	}
+	return ss.dialect.IsTransient != nil && ss.dialect.IsTransient(err)
+}
@@ -0,0 +1,102 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/jinzhu/gorm"
+)
+
+// errDeadlock stands for database specific error dialect reports as transient.
+var errDeadlock = errors.New("deadlock detected")
+
+func TestIsTransient(t *testing.T) {
+	ss := &sqlstore{dialect: Dialect{
+		Name:        "test",
+		IsTransient: func(err error) bool { return err == errDeadlock },
+	}}
+	failure := errors.New("syntax error")
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad connection", driver.ErrBadConn, true},
+		{"wrapped bad connection", fmt.Errorf("query: %w", driver.ErrBadConn), true},
+		{"connection done", sql.ErrConnDone, true},
+		{"eof", io.EOF, true},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"network", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"dns", &net.DNSError{Err: "no such host", Name: "db"}, true},
+		{"dialect", errDeadlock, true},
+		{"gorm errors with transient one", gorm.Errors{failure, driver.ErrBadConn}, true},
+		{"gorm errors", gorm.Errors{failure, sql.ErrNoRows}, false},
+		{"no rows", sql.ErrNoRows, false},
+		{"permanent", failure, false},
+	}
+	for _, tt := range tests {
+		if got := ss.isTransient(tt.err); got != tt.want {
+			t.Errorf("%v: isTransient(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+
+	// Dialect which does not classify errors leaves the rest permanent
+	ss.dialect.IsTransient = nil
+	if ss.isTransient(errDeadlock) {
+		t.Errorf("isTransient(%v) without dialect classification = true, want false", errDeadlock)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	ss := &sqlstore{
+		dialect: Dialect{Name: "test", IsTransient: func(err error) bool { return err == errDeadlock }},
+		logger:  logging.Default(),
+	}
+	classify := func(err error) error {
+		return ss.classify(context.Background(), &store.Operation{Name: "get"}, func(context.Context) error {
+			return err
+		})
+	}
+	failure := errors.New("syntax error")
+
+	// Errors describing state of records and already classified ones are returned as they are
+	for _, err := range []error{
+		nil,
+		store.ErrNotFound,
+		store.ErrAlreadyExists,
+		store.ErrConflict,
+		context.Canceled,
+		&store.Error{Backend: "other", Err: failure},
+	} {
+		if got := classify(err); got != err {
+			t.Errorf("classify(%v) = %v, want it unchanged", err, got)
+		}
+	}
+
+	for _, tt := range []struct {
+		err       error
+		transient bool
+	}{
+		{driver.ErrBadConn, true},
+		{errDeadlock, true},
+		{failure, false},
+	} {
+		err := classify(tt.err)
+		want := &store.Error{Backend: "test", Transient: tt.transient, Err: tt.err}
+		if got, ok := err.(*store.Error); !ok || *got != *want {
+			t.Errorf("classify(%v) = %#v, want %#v", tt.err, err, want)
+		}
+		if store.IsTransient(err) != tt.transient {
+			t.Errorf("IsTransient(%v) = %v, want %v", err, !tt.transient, tt.transient)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package sqlstore
+
+import (
+	"time"
+
+	"github.com/caelifer/runner/service/store"
+)
+
+// row is a data store record as persisted in records table. Record itself is kept serialized in Data,
+// columns are extracted from it for lookups.
+type row struct {
+	ID      string    `gorm:"primary_key;type:char(26)"`
+	Kind    string    `gorm:"type:varchar(32);not null"`
+	JobID   string    `gorm:"type:char(26);index"`
+	Name    string    `gorm:"type:varchar(255);index"`
+	Status  string    `gorm:"type:varchar(16);index"`
+	Success bool      `gorm:"not null"`
+	Created time.Time `gorm:"not null;index"`
+	// Owner claimed the row until it Expires, claims select rows by them.
+	Owner   string     `gorm:"type:varchar(255);not null;default:''"`
+	Expires *time.Time `gorm:"index"`
+	// Revision is compared on update to detect concurrent changes.
+	Revision int64  `gorm:"not null"`
+	Data     string `gorm:"size:16777215;not null"`
+}
+
+// TableName returns name of the table rows are stored in.
+func (row) TableName() string {
+	return "records"
+}
+
+// newRow serializes record into table row.
+func newRow(rec store.Record) (*row, error) {
+	kind, data, err := store.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := store.Summarize(rec)
+	r := &row{
+		ID:       rec.ID(),
+		Kind:     kind,
+		JobID:    sum.JobID,
+		Name:     sum.Name,
+		Status:   string(sum.Status),
+		Success:  rec.Success(),
+		Created:  sum.Created,
+		Owner:    sum.Owner,
+		Revision: rec.Revision(),
+		Data:     string(data),
+	}
+	if r.Created.IsZero() {
+		r.Created = time.Now()
+	}
+	if !sum.Expires.IsZero() {
+		r.Expires = &sum.Expires
+	}
+	return r, nil
+}
+
+// record restores record from table row.
+func (r *row) record() (store.Record, error) {
+	rec, err := store.Unmarshal(r.Kind, []byte(r.Data))
+	if err != nil {
+		return nil, err
+	}
+	rec.SetRevision(r.Revision)
+	return rec, nil
+}
+
+// columns returns values of columns which change when record is updated.
+func (r *row) columns() map[string]interface{} {
+	return map[string]interface{}{
+		"kind":     r.Kind,
+		"job_id":   r.JobID,
+		"name":     r.Name,
+		"status":   r.Status,
+		"success":  r.Success,
+		"owner":    r.Owner,
+		"expires":  r.Expires,
+		"revision": r.Revision,
+		"data":     r.Data,
+	}
+}
+
+// change is a row of changes table, it records every change made to records table and drives watches.
+type change struct {
+	Revision int64     `gorm:"primary_key;AUTO_INCREMENT"`
+	Type     string    `gorm:"type:varchar(8);not null"`
+	RecordID string    `gorm:"type:char(26);not null"`
+	Kind     string    `gorm:"type:varchar(32);not null"`
+	Data     string    `gorm:"size:16777215;not null"`
+	Created  time.Time `gorm:"not null"`
+}
+
+// TableName returns name of the table changes are stored in.
+func (change) TableName() string {
+	return "changes"
+}
+
+// newChange records change of the row.
+func newChange(typ store.EventType, r *row) *change {
+	return &change{
+		Type:     string(typ),
+		RecordID: r.ID,
+		Kind:     r.Kind,
+		Data:     r.Data,
+		Created:  time.Now(),
+	}
+}
+
+// event restores change event, record's revision is kept in its serialized state.
+func (c *change) event() (store.Event, error) {
+	rec, err := store.Unmarshal(c.Kind, []byte(c.Data))
+	if err != nil {
+		return store.Event{}, err
+	}
+	return store.Event{
+		Type:     store.EventType(c.Type),
+		Revision: c.Revision,
+		ID:       c.RecordID,
+		Record:   rec,
+	}, nil
+}
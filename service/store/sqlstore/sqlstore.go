@@ -0,0 +1,577 @@
+// Package sqlstore implements store.Service on top of SQL database accessed through gorm. Schema is shared
+// by all databases, backends for particular ones provide their Dialect.
+package sqlstore
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/caelifer/runner/service/logging"
+	"github.com/caelifer/runner/service/store"
+	"github.com/jinzhu/gorm"
+)
+
+// Exported errors.
+var (
+	// ErrNotFound error is returned when object is not found in the data store.
+	ErrNotFound = store.ErrNotFound
+	// ErrAlreadyExists error is returned when object with the same id is already in the data store.
+	ErrAlreadyExists = store.ErrAlreadyExists
+)
+
+// Dialect describes database specific behaviour of data store.
+type Dialect struct {
+	// Name is backend name reported in logs, metrics and traces.
+	Name string
+	// IsDuplicate reports whether err is database's duplicate key error.
+	IsDuplicate func(err error) bool
+	// IsTransient optionally reports whether err is database specific transient failure, e.g. deadlock;
+	// lost connections are recognized by data store itself.
+	IsTransient func(err error) bool
+	// Lock is clause appended to queries selecting rows to be claimed, e.g. "FOR UPDATE SKIP LOCKED".
+	Lock string
+	// Notify optionally announces changes made in transaction to watchers, it is called before commit.
+	Notify func(tx *gorm.DB) error
+	// Changed optionally returns channel which is closed on the next announced change, watchers wait for it
+	// besides polling.
+	Changed func() <-chan struct{}
+	// Close optionally releases dialect's resources, e.g. notification listener, when data store is closed.
+	Close func() error
+}
+
+// sqlstore is an internal type that implements store.Service interface.
+type sqlstore struct {
+	entropy io.Reader
+	db      *gorm.DB
+	dialect Dialect
+	logger  logging.Logger
+	poll    time.Duration
+	retries int
+	backoff time.Duration
+	history int64
+	// written is number of transactions committed by the process, changes table is compacted every history of them
+	written int64
+}
+
+// DefaultPollInterval is how often watchers check changes table for new changes.
+const DefaultPollInterval = 500 * time.Millisecond
+
+// DefaultHistory is minimal number of latest changes kept in changes table for resumed watches.
+const DefaultHistory = 1024
+
+// Option configures SQL data store.
+type Option func(*sqlstore)
+
+// WithLogger sets data store's logger.
+func WithLogger(l logging.Logger) Option {
+	return func(ss *sqlstore) {
+		ss.logger = l
+	}
+}
+
+// WithPollInterval sets how often watchers check for new changes.
+func WithPollInterval(d time.Duration) Option {
+	return func(ss *sqlstore) {
+		ss.poll = d
+	}
+}
+
+// WithHistory sets minimal number of latest changes kept for resumed watches, older ones are deleted from
+// changes table.
+func WithHistory(n int) Option {
+	return func(ss *sqlstore) {
+		if n > 0 {
+			ss.history = int64(n)
+		}
+	}
+}
+
+// WithRetry sets number of attempts made by operations failing transiently, e.g. while database restarts,
+// and initial delay between them; single attempt disables retries.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(ss *sqlstore) {
+		ss.retries = attempts
+		ss.backoff = backoff
+	}
+}
+
+// Params consumes parameters common to SQL data stores from data store's URL.
+func Params(p *store.Params, logger logging.Logger) []Option {
+	return []Option{
+		WithLogger(logger),
+		WithPollInterval(p.Duration("poll", DefaultPollInterval)),
+		WithHistory(p.Int("history", DefaultHistory)),
+		WithRetry(p.Int("retries", DefaultRetryAttempts), p.Duration("retry_backoff", DefaultRetryBackoff)),
+	}
+}
+
+// New creates new data store service on top of opened database, its schema is migrated if necessary.
+// Data store takes ownership of the database and closes it if migration fails.
+func New(db *gorm.DB, dialect Dialect, opts ...Option) (store.Service, error) {
+	ss := &sqlstore{
+		db:      db,
+		dialect: dialect,
+		logger:  logging.Default(),
+		poll:    DefaultPollInterval,
+		history: DefaultHistory,
+		retries: DefaultRetryAttempts,
+		backoff: DefaultRetryBackoff,
+		entropy: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, opt := range opts {
+		opt(ss)
+	}
+	ss.logger = ss.logger.With("component", "store", "backend", dialect.Name)
+	// Failures are logged by data store itself
+	db.LogMode(false)
+
+	// Records are persisted serialized, schema does not depend on record types
+	if err := db.AutoMigrate(&row{}, &change{}).Error; err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	// Failures are classified before they are retried, operations which keep failing are logged once
+	return store.Instrument(ss, dialect.Name, ss.logger, store.Retry(ss.retries, ss.backoff, store.IsTransient), ss.classify), nil
+}
+
+// Create new record in data store.
+func (ss *sqlstore) Create(ctx context.Context, record store.Record) error {
+	return ss.transact(func(tx *gorm.DB) error {
+		return ss.create(tx, record)
+	})
+}
+
+// Update existing record in data store.
+func (ss *sqlstore) Update(ctx context.Context, id string, record store.Record) (err error) {
+	// Record is written with the next revision, which is only kept if the write succeeds
+	rev := record.Revision()
+	defer func() {
+		if err != nil {
+			record.SetRevision(rev)
+		}
+	}()
+	return ss.transact(func(tx *gorm.DB) error {
+		return ss.update(tx, id, record)
+	})
+}
+
+// Delete existing record from data store.
+func (ss *sqlstore) Delete(ctx context.Context, id string) error {
+	return ss.transact(func(tx *gorm.DB) error {
+		return ss.remove(tx, id)
+	})
+}
+
+// Begin starts a batch of writes, which are applied in single database transaction on commit.
+func (ss *sqlstore) Begin(ctx context.Context) (store.Tx, error) {
+	return store.NewTx(func(ops []store.Op) (err error) {
+		// Records keep their revisions unless the whole batch is written
+		revs := make([]int64, len(ops))
+		for i, op := range ops {
+			if op.Record != nil {
+				revs[i] = op.Record.Revision()
+			}
+		}
+		defer func() {
+			if err != nil {
+				for i, op := range ops {
+					if op.Record != nil {
+						op.Record.SetRevision(revs[i])
+					}
+				}
+			}
+		}()
+
+		return ss.transact(func(tx *gorm.DB) error {
+			for _, op := range ops {
+				var err error
+				switch op.Type {
+				case store.EventCreate:
+					err = ss.create(tx, op.Record)
+				case store.EventUpdate:
+					err = ss.update(tx, op.ID, op.Record)
+				case store.EventDelete:
+					err = ss.remove(tx, op.ID)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}), nil
+}
+
+// create inserts new record within transaction.
+func (ss *sqlstore) create(tx *gorm.DB, record store.Record) error {
+	record.SetRevision(1)
+	r, err := newRow(record)
+	if err != nil {
+		return err
+	}
+	if err := tx.Create(r).Error; err != nil {
+		if ss.dialect.IsDuplicate(err) {
+			return ErrAlreadyExists
+		}
+		return err
+	}
+	return ss.changed(tx, store.EventCreate, r)
+}
+
+// update replaces stored record within transaction, provided record has not changed since it was read.
+// Record is advanced to the next revision, callers restore it if transaction fails.
+func (ss *sqlstore) update(tx *gorm.DB, id string, record store.Record) error {
+	rev := record.Revision()
+	record.SetRevision(rev + 1)
+	r, err := newRow(record)
+	if err != nil {
+		return err
+	}
+
+	res := tx.Model(&row{}).Where("id = ? AND revision = ?", id, rev).Updates(r.columns())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		ok, err := isPresent(tx, id)
+		switch {
+		case err != nil:
+			return err
+		case !ok:
+			return ErrNotFound
+		}
+		return store.ErrConflict
+	}
+	return ss.changed(tx, store.EventUpdate, r)
+}
+
+// remove deletes stored record within transaction, its last state is recorded in the change.
+func (ss *sqlstore) remove(tx *gorm.DB, id string) error {
+	var r row
+	if err := tx.Where("id = ?", id).First(&r).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if err := tx.Where("id = ?", id).Delete(&row{}).Error; err != nil {
+		return err
+	}
+	return ss.changed(tx, store.EventDelete, &r)
+}
+
+// Get retrieves record from data store based on provided id.
+func (ss *sqlstore) Get(ctx context.Context, id string) (record store.Record, err error) {
+	var r row
+	if err = ss.db.Where("id = ?", id).First(&r).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+	record, err = r.record()
+
+	return
+}
+
+// GetAll fetches all records from data store as a slice.
+func (ss *sqlstore) GetAll(ctx context.Context) (records []store.Record, err error) {
+	// IDs are ULIDs, so records are returned in creation order
+	var rows []row
+	if err = ss.db.Order("id").Find(&rows).Error; err != nil {
+		return
+	}
+	records = make([]store.Record, 0, len(rows))
+	for i := range rows {
+		rec, rerr := rows[i].record()
+		if rerr != nil {
+			err = rerr
+			return
+		}
+		records = append(records, rec)
+	}
+
+	return
+}
+
+// Find returns a page of records matching the query.
+func (ss *sqlstore) Find(ctx context.Context, q store.Query) (page store.Page, err error) {
+	if page.Revision, err = ss.revision(); err != nil {
+		return
+	}
+
+	db := where(ss.db.Model(&row{}), q)
+
+	// Labels are not indexed, rows are fetched in batches until the page is filled
+	limit := q.PageSize()
+	cursor := q.Cursor
+	for {
+		var rows []row
+		if err = db.Where("id > ?", cursor).Order("id").Limit(limit + 1).Find(&rows).Error; err != nil {
+			return
+		}
+		for i := range rows {
+			rec, rerr := rows[i].record()
+			if rerr != nil {
+				err = rerr
+				return
+			}
+			if !q.Match(rec) {
+				continue
+			}
+			if len(page.Records) == limit {
+				page.Next = page.Records[limit-1].ID()
+				return
+			}
+			page.Records = append(page.Records, rec)
+		}
+		if len(rows) <= limit {
+			return
+		}
+		cursor = rows[len(rows)-1].ID
+	}
+}
+
+// where restricts rows to those matching the query, but for labels which are not indexed.
+func where(db *gorm.DB, q store.Query) *gorm.DB {
+	if q.Kind != "" {
+		db = db.Where("kind = ?", q.Kind)
+	}
+	if q.ID != "" {
+		db = db.Where("id = ?", q.ID)
+	}
+	if len(q.Status) > 0 {
+		statuses := make([]string, len(q.Status))
+		for i, st := range q.Status {
+			statuses[i] = string(st)
+		}
+		db = db.Where("status IN (?)", statuses)
+	}
+	if q.JobID != "" {
+		db = db.Where("job_id = ?", q.JobID)
+	}
+	if q.Name != "" {
+		db = db.Where("name = ?", q.Name)
+	}
+	if !q.Since.IsZero() {
+		db = db.Where("created >= ?", q.Since)
+	}
+	if !q.Until.IsZero() {
+		db = db.Where("created < ?", q.Until)
+	}
+	if q.Owner != "" {
+		db = db.Where("owner = ?", q.Owner)
+	}
+	if !q.Free.IsZero() {
+		db = db.Where("owner = '' OR expires < ?", q.Free)
+	}
+	return db
+}
+
+// Watch delivers changes of records matching the filter until context is cancelled. Changes are polled
+// from changes table, so that changes made by other processes sharing the database are delivered too.
+func (ss *sqlstore) Watch(ctx context.Context, f store.Filter) (_ <-chan store.Event, err error) {
+	next := f.Revision
+	if next == 0 {
+		if next, err = ss.revision(); err != nil {
+			return
+		}
+	} else if err = ss.since(next); err != nil {
+		return
+	}
+
+	ch := make(chan store.Event, watchBatch)
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(ss.poll)
+		defer ticker.Stop()
+		for {
+			// Announcements made while changes are fetched are not missed
+			var changed <-chan struct{}
+			if ss.dialect.Changed != nil {
+				changed = ss.dialect.Changed()
+			}
+
+			var changes []change
+			err := ss.db.Where("revision > ?", next).Order("revision").Limit(watchBatch).Find(&changes).Error
+			if err != nil {
+				ss.logger.Error("store watch failed", "revision", next, "error", err.Error())
+			}
+			// Missing revisions are either compacted, or not committed yet
+			if len(changes) > 0 && changes[0].Revision > next+1 {
+				if err := ss.since(next); err == store.ErrCompacted {
+					// Watcher fell behind, it has to resume
+					ss.logger.Warn("store watch fell behind", "revision", next)
+					return
+				}
+			}
+
+			for _, c := range changes {
+				// Revisions are allocated before commit, so a gap may be filled by a transaction still
+				// in progress; it is waited for a while before it's considered rolled back
+				if c.Revision > next+1 && time.Since(c.Created) < gapTimeout {
+					break
+				}
+				next = c.Revision
+
+				e, err := c.event()
+				if err != nil {
+					ss.logger.Error("store watch failed", "revision", c.Revision, "error", err.Error())
+					continue
+				}
+				if !f.Query.Match(e.Record) {
+					continue
+				}
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-changed:
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// Claim modifies the first record matching the query, in creation order, which fn accepts by returning its
+// modified copy. Only the selected row is locked while fn decides, rows locked by concurrent claims are
+// skipped if dialect supports it. Nil record is returned if no row matches or fn declines it.
+func (ss *sqlstore) Claim(ctx context.Context, q store.Query, fn func(rec store.Record) store.Record) (claimed store.Record, err error) {
+	var rev int64
+	err = ss.transact(func(tx *gorm.DB) error {
+		query := where(tx.Model(&row{}), q)
+		if ss.dialect.Lock != "" {
+			query = query.Set("gorm:query_option", ss.dialect.Lock)
+		}
+		var rows []row
+		if err := query.Order("id").Limit(1).Find(&rows).Error; err != nil || len(rows) == 0 {
+			return err
+		}
+		rec, err := rows[0].record()
+		if err != nil {
+			return err
+		}
+		if claimed = fn(rec); claimed == nil {
+			return nil
+		}
+		rev = claimed.Revision()
+		return ss.update(tx, rows[0].ID, claimed)
+	})
+	if err != nil && claimed != nil {
+		claimed.SetRevision(rev)
+		claimed = nil
+	}
+	return
+}
+
+// Compact deletes changes but the latest one.
+func (ss *sqlstore) Compact(ctx context.Context) error {
+	return ss.trim(1)
+}
+
+// Close closes database connections.
+func (ss *sqlstore) Close() error {
+	if ss.dialect.Close != nil {
+		if err := ss.dialect.Close(); err != nil {
+			_ = ss.db.Close()
+			return err
+		}
+	}
+	return ss.db.Close()
+}
+
+// watchBatch is maximal number of changes fetched by watcher at once.
+const watchBatch = 100
+
+// gapTimeout is how long watcher waits for missing revision to be committed.
+const gapTimeout = 5 * time.Second
+
+// changed records change of the row within transaction and announces it.
+func (ss *sqlstore) changed(tx *gorm.DB, typ store.EventType, r *row) error {
+	if err := tx.Create(newChange(typ, r)).Error; err != nil {
+		return err
+	}
+	if ss.dialect.Notify != nil {
+		return ss.dialect.Notify(tx)
+	}
+	return nil
+}
+
+// since checks that changes following provided revision are kept, ErrCompacted is returned otherwise.
+func (ss *sqlstore) since(rev int64) error {
+	var oldest int64
+	if err := ss.db.Model(&change{}).Select("COALESCE(MIN(revision), 0)").Row().Scan(&oldest); err != nil {
+		return err
+	}
+	if oldest > rev+1 {
+		return store.ErrCompacted
+	}
+	return nil
+}
+
+// compact deletes changes but the latest history ones, it is done once every history writes, so that
+// changes table does not grow without limit.
+func (ss *sqlstore) compact() {
+	if atomic.AddInt64(&ss.written, 1)%ss.history != 0 {
+		return
+	}
+	if err := ss.trim(ss.history); err != nil {
+		// Write is already committed, failed compaction only leaves more changes behind
+		ss.logger.Warn("store changes compaction failed", "error", err.Error())
+	}
+}
+
+// trim deletes changes but the latest n ones.
+func (ss *sqlstore) trim(n int64) error {
+	rev, err := ss.revision()
+	if err != nil {
+		return err
+	}
+	return ss.db.Where("revision <= ?", rev-n).Delete(&change{}).Error
+}
+
+// revision returns revision of the latest change.
+func (ss *sqlstore) revision() (rev int64, err error) {
+	err = ss.db.Model(&change{}).Select("COALESCE(MAX(revision), 0)").Row().Scan(&rev)
+	return
+}
+
+// transact runs fn in database transaction, which is committed if fn succeeds and rolled back otherwise. Changes
+// table is compacted once in a while after commit.
+func (ss *sqlstore) transact(fn func(tx *gorm.DB) error) error {
+	tx := ss.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	ss.compact()
+	return nil
+}
+
+// isPresent checks if record with given id exists in data store.
+func isPresent(db *gorm.DB, id string) (bool, error) {
+	var n int
+	if err := db.Model(&row{}).Where("id = ?", id).Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
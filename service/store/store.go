@@ -1,14 +1,82 @@
 package store
 
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Exported errors, backends return them for the same conditions.
+var (
+	// ErrNotFound error is returned when object is not found in the data store.
+	ErrNotFound = errors.New("object not found")
+	// ErrAlreadyExists error is returned when object with the same id is already in the data store.
+	ErrAlreadyExists = errors.New("object already exists")
+)
+
+// Error is a failure of database data store is built on, as opposed to errors describing state of records,
+// e.g. ErrNotFound. Transient failures, e.g. lost connection or deadlock, may succeed when retried; permanent
+// ones, e.g. denied access, will not.
+type Error struct {
+	// Backend is name of data store's backend.
+	Backend   string
+	Transient bool
+	Err       error
+}
+
+func (e *Error) Error() string {
+	if e.Transient {
+		return fmt.Sprintf("store: %v: transient failure: %v", e.Backend, e.Err)
+	}
+	return fmt.Sprintf("store: %v: %v", e.Backend, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient reports whether err is transient failure of data store's database.
+func IsTransient(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Transient
+}
+
 type Record interface {
 	ID() string
 	Success() bool
+	// Revision returns revision of record's stored state, it is zero for records which were never stored.
+	// Update expects it to match the stored revision.
+	Revision() int64
+	// SetRevision is used by data stores to update record's revision when it is written.
+	SetRevision(rev int64)
 }
 
 type Service interface {
-	Create(rec Record) error
-	Update(id string, rec Record) error
-	Delete(id string) error
-	Get(id string) (rec Record, err error)
-	GetAll() (recs []Record, err error)
+	Create(ctx context.Context, rec Record) error
+	// Update replaces stored record whose revision matches rec's one, ErrConflict is returned otherwise.
+	Update(ctx context.Context, id string, rec Record) error
+	Delete(ctx context.Context, id string) error
+	Get(ctx context.Context, id string) (rec Record, err error)
+	GetAll(ctx context.Context) (recs []Record, err error)
+	// Find returns a page of records matching the query.
+	Find(ctx context.Context, q Query) (page Page, err error)
+	// Watch delivers changes of records matching the filter until context is cancelled. Channel is also
+	// closed if watcher falls too far behind, watching may be resumed from the last received revision.
+	Watch(ctx context.Context, f Filter) (<-chan Event, error)
+	// Begin starts a batch of writes applied atomically.
+	Begin(ctx context.Context) (Tx, error)
+	// Compact discards history of changes kept for resumed watches but the latest change, so that data of
+	// deleted records is not kept. Watches resumed from before it fail with ErrCompacted.
+	Compact(ctx context.Context) error
+	// Close flushes pending writes and releases data store's resources, data store must not be used afterwards.
+	Close() error
+}
+
+// Claimer is implemented by data stores able to claim records under row locks, so that concurrent consumers,
+// e.g. queue workers, do not race for the same record.
+type Claimer interface {
+	// Claim locks the first record matching the query, in creation order, and writes its modified copy if fn
+	// accepts the record by returning the copy. Nil record is returned if no record matches or fn declines it.
+	// Query's labels, cursor and limit are not considered.
+	Claim(ctx context.Context, q Query, fn func(rec Record) Record) (Record, error)
 }
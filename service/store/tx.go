@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Exported errors.
+var (
+	// ErrTxDone error is returned when committed or rolled back transaction is used again.
+	ErrTxDone = errors.New("transaction is already committed or rolled back")
+)
+
+// Tx is a batch of writes which are applied atomically on commit: either all of them succeed or none does.
+type Tx interface {
+	// Create adds new records to the batch.
+	Create(recs ...Record)
+	// Update adds replacement of stored records to the batch, revisions are checked like in Service.Update.
+	Update(recs ...Record)
+	// Delete adds removal of records to the batch.
+	Delete(ids ...string)
+	// Commit applies the batch.
+	Commit() error
+	// Rollback discards the batch.
+	Rollback() error
+}
+
+// Op is a single write of the batch.
+type Op struct {
+	Type   EventType
+	ID     string
+	Record Record
+}
+
+// tx buffers writes until they are committed.
+type tx struct {
+	mu     sync.Mutex
+	ops    []Op
+	done   bool
+	commit func(ops []Op) error
+}
+
+// NewTx creates transaction which buffers writes, on commit they are applied by provided function. It is meant
+// to be used by data stores implementing Service.Begin.
+func NewTx(commit func(ops []Op) error) Tx {
+	return &tx{commit: commit}
+}
+
+func (t *tx) Create(recs ...Record) {
+	t.add(EventCreate, recs...)
+}
+
+func (t *tx) Update(recs ...Record) {
+	t.add(EventUpdate, recs...)
+}
+
+func (t *tx) Delete(ids ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, id := range ids {
+		t.ops = append(t.ops, Op{Type: EventDelete, ID: id})
+	}
+}
+
+func (t *tx) Commit() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+	if len(t.ops) == 0 {
+		return nil
+	}
+	return t.commit(t.ops)
+}
+
+func (t *tx) Rollback() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+	t.ops = nil
+	return nil
+}
+
+func (t *tx) add(typ EventType, recs ...Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, rec := range recs {
+		t.ops = append(t.ops, Op{Type: typ, ID: rec.ID(), Record: rec})
+	}
+}
+
+// SaveAll atomically updates records, resolving conflicts with concurrent changes like Save does.
+// Resolver is created for every conflicting record with its state being written.
+func SaveAll(ctx context.Context, s Service, recs []Record, resolver func(rec Record) func(stored Record) Record) error {
+	for i := 0; ; i++ {
+		t, err := s.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		t.Update(recs...)
+		err = t.Commit()
+		if err != ErrConflict || i == maxConflicts {
+			return err
+		}
+
+		// Refresh revisions, records whose stored state is newer are left out
+		var keep []Record
+		for _, rec := range recs {
+			stored, err := s.Get(ctx, rec.ID())
+			if err != nil {
+				return err
+			}
+			if r := resolver(rec)(stored); r != nil {
+				keep = append(keep, r)
+			}
+		}
+		if recs = keep; len(recs) == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package store
+
+import "errors"
+
+// EventType is a kind of change made to a record.
+type EventType string
+
+// Event types.
+const (
+	EventCreate EventType = "create"
+	EventUpdate EventType = "update"
+	EventDelete EventType = "delete"
+)
+
+// Exported errors.
+var (
+	// ErrCompacted error is returned when watch is resumed from revision data store no longer keeps events for.
+	ErrCompacted = errors.New("revision is compacted")
+)
+
+// Event describes change made to a record.
+type Event struct {
+	Type EventType
+	// Revision orders all changes made to data store, it grows with every change.
+	Revision int64
+	ID       string
+	// Record is record's state after the change, or the last state of deleted record.
+	Record Record
+}
+
+// Filter selects events delivered by Watch.
+type Filter struct {
+	// Query selects records whose changes are delivered, its cursor and limit are ignored.
+	Query Query
+	// Revision resumes watching after the event with this revision, zero delivers only future changes.
+	Revision int64
+}
@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Collector is a minimal in-memory OTLP/HTTP JSON trace collector, it is meant for tests and local debugging.
+// Mount it at the root of a test HTTP server and point OTLP exporter to the server's URL.
+type Collector struct {
+	mu    sync.Mutex
+	spans []CollectedSpan
+}
+
+// CollectedSpan is a span received by collector.
+type CollectedSpan struct {
+	Service      string
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Error        string
+}
+
+// NewCollector creates empty collector.
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// ServeHTTP accepts OTLP/HTTP JSON export requests at /v1/traces, it implements http.Handler interface.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req otlpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		service := ""
+		for _, kv := range rs.Resource.Attributes {
+			if kv.Key == "service.name" && kv.Value.StringValue != nil {
+				service = *kv.Value.StringValue
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans = append(c.spans, CollectedSpan{
+					Service:      service,
+					TraceID:      s.TraceID,
+					SpanID:       s.SpanID,
+					ParentSpanID: s.ParentSpanID,
+					Name:         s.Name,
+					Error:        s.Status.Message,
+				})
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte("{}"))
+}
+
+// Spans returns all spans received so far.
+func (c *Collector) Spans() []CollectedSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CollectedSpan(nil), c.spans...)
+}
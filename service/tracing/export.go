@@ -0,0 +1,211 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// fileExporter writes spans as JSON lines.
+type fileExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewFileExporter creates exporter writing every span as a JSON line to w.
+func NewFileExporter(w io.Writer) Exporter {
+	return &fileExporter{w: w}
+}
+
+// Export writes spans, it implements Exporter interface.
+func (e *fileExporter) Export(_ context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpExporter sends spans to OpenTelemetry collector using OTLP/HTTP with JSON encoding.
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+// NewOTLPExporter creates exporter posting spans to OTLP/HTTP collector at provided base URL,
+// e.g. "http://localhost:4318". Spans are reported under provided service name.
+func NewOTLPExporter(endpoint, service string) Exporter {
+	return &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   http.DefaultClient,
+	}
+}
+
+// Export posts spans to collector, it implements Exporter interface.
+func (e *otlpExporter) Export(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(newOTLPRequest(e.service, spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export: unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// OTLP/JSON wire types, only the subset used by the exporter.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+// OTLP span kind and status codes.
+const (
+	otlpKindInternal = 1
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+func newOTLPRequest(service string, spans []SpanData) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		for k, v := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpKeyValue{Key: k, Value: newOTLPValue(v)})
+		}
+		out = append(out, span)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{{Key: "service.name", Value: newOTLPValue(service)}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/caelifer/runner"},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+func newOTLPValue(v interface{}) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+// multiExporter sends spans to several exporters.
+type multiExporter []Exporter
+
+// MultiExporter creates exporter which sends spans to all provided exporters.
+func MultiExporter(exporters ...Exporter) Exporter {
+	if len(exporters) == 1 {
+		return exporters[0]
+	}
+	return multiExporter(exporters)
+}
+
+// Export sends spans to every exporter and returns the first error, it implements Exporter interface.
+func (m multiExporter) Export(ctx context.Context, spans []SpanData) error {
+	var first error
+	for _, e := range m {
+		if err := e.Export(ctx, spans); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,325 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvVar is the name of environment variable carrying W3C trace context to child processes.
+const EnvVar = "TRACEPARENT"
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// String returns hex encoded trace id.
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns hex encoded span id.
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext is a part of span which is propagated across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid reports whether span context has non-zero ids.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats span context as W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%v-%v-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceparent parses W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %v", s, err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %v", s, err)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q: zero id", s)
+	}
+	return sc, nil
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	tracer *Tracer
+
+	mu   sync.Mutex
+	data SpanData
+	done bool
+}
+
+// SpanData is a snapshot of finished span handed to exporters.
+type SpanData struct {
+	Name       string                 `json:"name"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+
+	context SpanContext
+}
+
+// Context returns span's propagated context.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.context
+}
+
+// SetAttribute sets span attribute, values are expected to be strings, numbers or booleans.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+// End finishes span, non-nil error marks span as failed. Only the first call has effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.data.End = time.Now()
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+	data := s.data
+	s.mu.Unlock()
+
+	s.tracer.record(data)
+}
+
+// Exporter sends finished spans to their destination.
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+// Tracer creates spans and exports them in batches.
+type Tracer struct {
+	exporter Exporter
+	service  string
+
+	mu      sync.Mutex
+	buf     []SpanData
+	flush   chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// batchSize is number of buffered spans which triggers export.
+const batchSize = 256
+
+// flushInterval is how often buffered spans are exported.
+const flushInterval = time.Second
+
+// NewTracer creates tracer exporting spans with provided exporter. Service name is reported to exporters
+// which support it.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		service:  service,
+		flush:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// Service returns service name tracer reports spans for.
+func (t *Tracer) Service() string {
+	return t.service
+}
+
+// Shutdown exports buffered spans and stops background exporting.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	select {
+	case <-t.stop:
+		return errors.New("tracer is already shut down")
+	default:
+	}
+	close(t.stop)
+
+	select {
+	case <-t.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.export(ctx)
+}
+
+func (t *Tracer) loop() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		case <-t.flush:
+		}
+		_ = t.export(context.Background())
+	}
+}
+
+func (t *Tracer) record(data SpanData) {
+	if t == nil || t.exporter == nil {
+		return
+	}
+	t.mu.Lock()
+	t.buf = append(t.buf, data)
+	full := len(t.buf) >= batchSize
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) export(ctx context.Context) error {
+	t.mu.Lock()
+	spans := t.buf
+	t.buf = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+	return t.exporter.Export(ctx, spans)
+}
+
+// defaultTracer is used to create spans, nil tracer still propagates trace context but exports nothing.
+var (
+	defaultMu     sync.RWMutex
+	defaultTracer *Tracer
+)
+
+// SetDefault installs tracer used by Start.
+func SetDefault(t *Tracer) {
+	defaultMu.Lock()
+	defaultTracer = t
+	defaultMu.Unlock()
+}
+
+// Default returns installed tracer, or nil if tracing is not configured.
+func Default() *Tracer {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultTracer
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// Start creates span as a child of the span in provided context, or of remote parent installed with
+// WithRemoteParent, or as a new trace root. Attributes are alternating keys and values.
+func Start(ctx context.Context, name string, attrs ...interface{}) (context.Context, *Span) {
+	s := &Span{
+		tracer: Default(),
+		data: SpanData{
+			Name:  name,
+			Start: time.Now(),
+		},
+	}
+
+	var parent SpanContext
+	if p, ok := ctx.Value(spanKey{}).(*Span); ok {
+		parent = p.Context()
+	} else if r, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = r
+	}
+	if parent.IsValid() {
+		s.data.context.TraceID = parent.TraceID
+		s.data.ParentID = parent.SpanID.String()
+	} else {
+		_, _ = rand.Read(s.data.context.TraceID[:])
+	}
+	_, _ = rand.Read(s.data.context.SpanID[:])
+	s.data.TraceID = s.data.context.TraceID.String()
+	s.data.SpanID = s.data.context.SpanID.String()
+
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if k, ok := attrs[i].(string); ok {
+			s.SetAttribute(k, attrs[i+1])
+		}
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns current span, or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// WithRemoteParent returns context whose next span continues trace started in another process.
+func WithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Traceparent returns W3C traceparent of the current span, or empty string if there is none.
+func Traceparent(ctx context.Context) string {
+	if s := FromContext(ctx); s != nil {
+		return s.Context().Traceparent()
+	}
+	return ""
+}
+
+// Environ returns environment variables propagating current trace to a child process.
+func Environ(ctx context.Context) []string {
+	if tp := Traceparent(ctx); tp != "" {
+		return []string{EnvVar + "=" + tp}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// install sets tracer exporting to provided exporter as the default one for the duration of the test.
+func install(t *testing.T, exporter Exporter) *Tracer {
+	t.Helper()
+	tr := NewTracer("runner", exporter)
+	prev := Default()
+	SetDefault(tr)
+	t.Cleanup(func() { SetDefault(prev) })
+	return tr
+}
+
+func TestParseTraceparent(t *testing.T) {
+	valid := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	tests := []struct {
+		in  string
+		err bool
+	}{
+		{valid, false},
+		{" " + valid + "\n", false},
+		{"", true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331", true},
+		{"00-0af7651916cd43dd8448eb211c80319-b7ad6b7169203331-01", true},
+		{"00-zzf7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", true},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", true},
+	}
+	for _, tt := range tests {
+		sc, err := ParseTraceparent(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseTraceparent(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && sc.Traceparent() != valid {
+			t.Errorf("ParseTraceparent(%q).Traceparent() = %q", tt.in, sc.Traceparent())
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	var buf bytes.Buffer
+	tr := install(t, NewFileExporter(&buf))
+
+	remote, err := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, job := Start(WithRemoteParent(context.Background(), remote), "job.run", "job_id", "j1")
+	ctx, task := Start(ctx, "task.execute")
+	if env := Environ(ctx); len(env) != 1 || env[0] != EnvVar+"="+task.Context().Traceparent() {
+		t.Errorf("Environ() = %v", env)
+	}
+	task.End(errors.New("exit status 1"))
+	task.End(nil)
+	job.End(nil)
+	_, root := Start(context.Background(), "store.get")
+	root.End(nil)
+
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var spans []SpanData
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var s SpanData
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, s)
+	}
+	tests := []struct {
+		name    string
+		traceID string
+		parent  string
+		err     string
+	}{
+		{"task.execute", remote.TraceID.String(), job.Context().SpanID.String(), "exit status 1"},
+		{"job.run", remote.TraceID.String(), remote.SpanID.String(), ""},
+		{"store.get", root.Context().TraceID.String(), "", ""},
+	}
+	if len(spans) != len(tests) {
+		t.Fatalf("exported %d spans, want %d", len(spans), len(tests))
+	}
+	for i, tt := range tests {
+		s := spans[i]
+		if s.Name != tt.name || s.TraceID != tt.traceID || s.ParentID != tt.parent || s.Error != tt.err {
+			t.Errorf("span %d = %+v, want %v in trace %v with parent %q", i, s, tt.name, tt.traceID, tt.parent)
+		}
+		if s.End.Before(s.Start) {
+			t.Errorf("span %v ends before it starts", s.Name)
+		}
+	}
+	if spans[1].Attributes["job_id"] != "j1" {
+		t.Errorf("job span attributes = %v", spans[1].Attributes)
+	}
+	if spans[2].TraceID == remote.TraceID.String() {
+		t.Error("span without parent continues remote trace")
+	}
+}
+
+func TestNoTracer(t *testing.T) {
+	SetDefault(nil)
+	ctx, s := Start(context.Background(), "job.run")
+	if !s.Context().IsValid() || Traceparent(ctx) == "" {
+		t.Error("trace context is not propagated without tracer")
+	}
+	s.End(nil)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	c := NewCollector()
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	tr := install(t, NewOTLPExporter(srv.URL, "runner"))
+
+	ctx, parent := Start(context.Background(), "job.run")
+	_, child := Start(ctx, "task.execute", "attempt", 1)
+	child.End(errors.New("boom"))
+	parent.End(nil)
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := c.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("collector received %d spans, want 2", len(spans))
+	}
+	got := spans[0]
+	if got.Service != "runner" || got.Name != "task.execute" || got.Error != "boom" ||
+		!strings.EqualFold(got.TraceID, parent.Context().TraceID.String()) ||
+		!strings.EqualFold(got.ParentSpanID, parent.Context().SpanID.String()) {
+		t.Errorf("collected span = %+v", got)
+	}
+	if err := tr.Shutdown(context.Background()); err == nil {
+		t.Error("second Shutdown() succeeded")
+	}
+}
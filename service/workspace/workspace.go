@@ -0,0 +1,208 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// EnvVar is the name of environment variable used to pass workspace directory to tasks.
+const EnvVar = "RUNNER_WORKSPACE"
+
+// Policy defines when workspace directory is removed.
+type Policy int
+
+// Supported cleanup policies.
+const (
+	// CleanupAlways removes workspace as soon as its owner finishes.
+	CleanupAlways Policy = iota
+	// CleanupOnSuccess removes workspace only if its owner succeeded, failed workspaces are kept for inspection.
+	CleanupOnSuccess
+	// CleanupNever keeps workspace forever.
+	CleanupNever
+	// CleanupAfter keeps workspace for configured TTL after its owner finishes.
+	CleanupAfter
+)
+
+// Exported errors.
+var (
+	// ErrInvalidID error is returned when workspace id can not be used as directory name.
+	ErrInvalidID = errors.New("invalid workspace id")
+)
+
+// Manager creates and cleans up workspace directories under a common root.
+type Manager struct {
+	root    string
+	policy  Policy
+	ttl     time.Duration
+	perTask bool
+}
+
+// Option configures Manager.
+type Option func(*Manager)
+
+// WithTTL sets how long workspaces are kept with CleanupAfter policy.
+func WithTTL(ttl time.Duration) Option {
+	return func(m *Manager) {
+		m.ttl = ttl
+	}
+}
+
+// WithPerTask enables dedicated workspace for every task inside job's workspace.
+func WithPerTask() Option {
+	return func(m *Manager) {
+		m.perTask = true
+	}
+}
+
+// New creates new workspace manager rooted at provided directory.
+func New(root string, policy Policy, opts ...Option) *Manager {
+	m := &Manager{
+		root:   root,
+		policy: policy,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// PerTask reports whether every task gets its own workspace.
+func (m *Manager) PerTask() bool {
+	return m.perTask
+}
+
+// Create makes new workspace directory for provided id. Expired workspaces are swept first.
+func (m *Manager) Create(id string) (*Workspace, error) {
+	if err := m.Sweep(); err != nil {
+		return nil, err
+	}
+	return m.create(m.root, id)
+}
+
+// Sweep removes workspaces which outlived their TTL. It is a no-op for all policies but CleanupAfter.
+func (m *Manager) Sweep() error {
+	if m.policy != CleanupAfter {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(m.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	deadline := time.Now().Add(-m.ttl)
+	for _, e := range entries {
+		if !e.IsDir() || e.ModTime().After(deadline) || isActive(filepath.Join(m.root, e.Name())) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(m.root, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes workspace of provided id together with its nested workspaces, e.g. once job's history is
+// deleted. Missing workspace is not an error.
+func (m *Manager) Remove(id string) error {
+	if !validID(id) {
+		return ErrInvalidID
+	}
+	return os.RemoveAll(filepath.Join(m.root, id))
+}
+
+// Exists reports whether workspace of provided id was kept.
+func (m *Manager) Exists(id string) bool {
+	if !validID(id) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(m.root, id))
+	return err == nil
+}
+
+func validID(id string) bool {
+	return id != "" && id == filepath.Base(id) && id != "." && id != ".."
+}
+
+func (m *Manager) create(parent, id string) (*Workspace, error) {
+	if !validID(id) {
+		return nil, ErrInvalidID
+	}
+
+	dir := filepath.Join(parent, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// Mark workspace as active, so concurrent sweeps leave it alone
+	if err := ioutil.WriteFile(filepath.Join(dir, activeMarker), nil, 0644); err != nil {
+		return nil, err
+	}
+
+	return &Workspace{dir: dir, m: m}, nil
+}
+
+// activeMarker is a file present in workspace while its owner is running.
+const activeMarker = ".runner-active"
+
+func isActive(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, activeMarker))
+	return err == nil
+}
+
+// Workspace is a dedicated directory owned by single job or task.
+type Workspace struct {
+	dir string
+	m   *Manager
+}
+
+// Dir returns workspace directory path.
+func (w *Workspace) Dir() string {
+	return w.dir
+}
+
+// Sub creates nested workspace, typically used for a task inside job's workspace.
+func (w *Workspace) Sub(id string) (*Workspace, error) {
+	return w.m.create(w.dir, id)
+}
+
+// Release applies cleanup policy to the workspace once its owner finished.
+func (w *Workspace) Release(success bool) error {
+	switch w.m.policy {
+	case CleanupAlways:
+		return os.RemoveAll(w.dir)
+	case CleanupOnSuccess:
+		if success {
+			return os.RemoveAll(w.dir)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(w.dir, activeMarker)); err != nil {
+		return err
+	}
+	if w.m.policy == CleanupAfter {
+		// TTL is counted from the moment owner finished
+		now := time.Now()
+		return os.Chtimes(w.dir, now, now)
+	}
+	return nil
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of parent context carrying workspace directory.
+func NewContext(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, dir)
+}
+
+// FromContext returns workspace directory stored in context, if any.
+func FromContext(ctx context.Context) (string, bool) {
+	dir, ok := ctx.Value(ctxKey{}).(string)
+	return dir, ok
+}
@@ -0,0 +1,113 @@
+package workspace
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRelease(t *testing.T) {
+	tests := []struct {
+		policy  Policy
+		success bool
+		kept    bool
+	}{
+		{CleanupAlways, true, false},
+		{CleanupAlways, false, false},
+		{CleanupOnSuccess, true, false},
+		{CleanupOnSuccess, false, true},
+		{CleanupNever, true, true},
+		{CleanupNever, false, true},
+		{CleanupAfter, true, true},
+	}
+	for _, tt := range tests {
+		root := t.TempDir()
+		m := New(root, tt.policy, WithPerTask())
+		w, err := m.Create("job")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := w.Sub("task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.Dir() != filepath.Join(root, "job", "task") || !isActive(sub.Dir()) {
+			t.Fatalf("task workspace %v is not active inside job's one", sub.Dir())
+		}
+
+		if err := w.Release(tt.success); err != nil {
+			t.Fatal(err)
+		}
+		if kept := exists(w.Dir()); kept != tt.kept {
+			t.Errorf("policy %v, success %v: workspace kept = %v, want %v", tt.policy, tt.success, kept, tt.kept)
+		}
+		if tt.kept && isActive(w.Dir()) {
+			t.Errorf("policy %v: released workspace is still active", tt.policy)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	root := t.TempDir()
+	m := New(root, CleanupAfter, WithTTL(time.Hour))
+
+	expired, err := m.Create("expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := expired.Release(false); err != nil {
+		t.Fatal(err)
+	}
+	recent, err := m.Create("recent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recent.Release(true); err != nil {
+		t.Fatal(err)
+	}
+	active, err := m.Create("active")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, dir := range []string{expired.Dir(), active.Dir()} {
+		if err := os.Chtimes(dir, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+
+	for dir, want := range map[string]bool{expired.Dir(): false, recent.Dir(): true, active.Dir(): true} {
+		if got := exists(dir); got != want {
+			t.Errorf("%v kept = %v, want %v", filepath.Base(dir), got, want)
+		}
+	}
+}
+
+func TestInvalidID(t *testing.T) {
+	m := New(t.TempDir(), CleanupAlways)
+	for _, id := range []string{"", ".", "..", "a/b", "../escape"} {
+		if _, err := m.Create(id); err != ErrInvalidID {
+			t.Errorf("Create(%q) = %v, want %v", id, err, ErrInvalidID)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("FromContext() found workspace in empty context")
+	}
+	if dir, ok := FromContext(NewContext(context.Background(), "/ws")); !ok || dir != "/ws" {
+		t.Errorf("FromContext() = %q, %v", dir, ok)
+	}
+}